@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"math"
+)
+
+// A Kernel is a convolution kernel of any size, its values row by row. It is
+// anchored on its centre, (Width/2, Height/2), and applied without flipping,
+// as imaging.Convolve5x5 did.
+type Kernel struct {
+	Width, Height int
+	Values        []float64
+}
+
+func NewKernel(width, height int, values []float64) (Kernel, error) {
+	if width < 1 || height < 1 {
+		return Kernel{}, fmt.Errorf("invalid %dx%d kernel", width, height)
+	}
+	if len(values) != width*height {
+		return Kernel{}, fmt.Errorf("%dx%d kernel needs %d values, not %d", width, height, width*height, len(values))
+	}
+	return Kernel{Width: width, Height: height, Values: values}, nil
+}
+
+// separable splits the kernel into a column and a row vector whose outer
+// product it is, when it has rank 1.
+func (k Kernel) separable() (col, row []float64, ok bool) {
+	pivot := 0
+	for i, v := range k.Values {
+		if math.Abs(v) > math.Abs(k.Values[pivot]) {
+			pivot = i
+		}
+	}
+	p := k.Values[pivot]
+	if p == 0 {
+		return nil, nil, false
+	}
+	px, py := pivot%k.Width, pivot/k.Width
+	col = make([]float64, k.Height)
+	for y := range col {
+		col[y] = k.Values[y*k.Width+px]
+	}
+	row = make([]float64, k.Width)
+	for x := range row {
+		row[x] = k.Values[py*k.Width+x] / p
+	}
+	for y := range col {
+		for x := range row {
+			if math.Abs(col[y]*row[x]-k.Values[y*k.Width+x]) > 1e-9*math.Abs(p) {
+				return nil, nil, false
+			}
+		}
+	}
+	return col, row, true
+}
+
+// A BorderMode tells which pixels a kernel sees beyond the image.
+type BorderMode int
+
+const (
+	BorderReplicate BorderMode = iota // the nearest edge pixel, as imaging.Convolve5x5
+	BorderReflect                     // mirrored on the edge pixel: 2 1 | 0 1 2
+	BorderWrap                        // the other side of the image
+	BorderZero                        // 0
+)
+
+var borderModeNames = []string{"replicate", "reflect", "wrap", "zero"}
+
+func (m BorderMode) String() string {
+	if int(m) < len(borderModeNames) {
+		return borderModeNames[m]
+	}
+	return fmt.Sprintf("BorderMode(%d)", int(m))
+}
+
+func BorderModeByName(name string) (BorderMode, error) {
+	for i, n := range borderModeNames {
+		if n == name {
+			return BorderMode(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown border mode %q, expected one of %v", name, borderModeNames)
+}
+
+// borderIndex maps the coordinates from -before to n+after-1 into [0, n),
+// or -1 for a pixel of BorderZero.
+func borderIndex(n, before, after int, mode BorderMode) []int {
+	index := make([]int, before+n+after)
+	for i := range index {
+		v := i - before
+		switch mode {
+		case BorderReplicate:
+			if v < 0 {
+				v = 0
+			} else if v >= n {
+				v = n - 1
+			}
+		case BorderReflect:
+			if n == 1 {
+				v = 0
+				break
+			}
+			period := 2 * (n - 1)
+			v %= period
+			if v < 0 {
+				v += period
+			}
+			if v >= n {
+				v = period - v
+			}
+		case BorderWrap:
+			v %= n
+			if v < 0 {
+				v += n
+			}
+		case BorderZero:
+			if v < 0 || v >= n {
+				v = -1
+			}
+		}
+		index[i] = v
+	}
+	return index
+}
+
+// A SignedGray is a gray image of signed float32 samples, e.g. the response
+// of a convolution, which an image.Gray would clamp to [0, 255].
+type SignedGray struct {
+	Pix    []float32
+	Stride int
+	Rect   image.Rectangle
+}
+
+func NewSignedGray(r image.Rectangle) *SignedGray {
+	return &SignedGray{Pix: make([]float32, r.Dx()*r.Dy()), Stride: r.Dx(), Rect: r}
+}
+
+func (s *SignedGray) PixOffset(x, y int) int {
+	return (y-s.Rect.Min.Y)*s.Stride + (x - s.Rect.Min.X)
+}
+
+// Clamp rounds the samples to the nearest integer in [0, 255], negative
+// responses become 0, as imaging.Convolve5x5 returned them.
+func (s *SignedGray) Clamp() *image.Gray {
+	gray := image.NewGray(s.Rect)
+	for y := 0; y < s.Rect.Dy(); y++ {
+		src := s.Pix[y*s.Stride : y*s.Stride+s.Rect.Dx()]
+		dst := gray.Pix[y*gray.Stride:]
+		for x, v := range src {
+			switch {
+			case v >= 254.5:
+				dst[x] = 255
+			case v > 0:
+				dst[x] = uint8(v + 0.5)
+			default:
+				dst[x] = 0
+			}
+		}
+	}
+	return gray
+}
+
+// Convolve applies the kernel to every pixel of img, with the samples beyond
+// the image given by border. A kernel of rank 1, e.g. Sobel, is applied as a
+// column then a row vector, in Width+Height instead of Width*Height
+// operations per pixel.
+func Convolve(img *image.Gray, k Kernel, border BorderMode) *SignedGray {
+	out := NewSignedGray(img.Rect)
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	if w == 0 || h == 0 {
+		return out
+	}
+	ax, ay := k.Width/2, k.Height/2
+	xs := borderIndex(w, ax, k.Width-1-ax, border)
+	ys := borderIndex(h, ay, k.Height-1-ay, border)
+	pixel := func(x, y int) float32 {
+		return float32(img.Pix[y*img.Stride+x])
+	}
+
+	if col, row, ok := k.separable(); ok && k.Width > 1 && k.Height > 1 {
+		// rows first, over the rows the column vector reaches
+		tmp := make([]float32, len(ys)*w)
+		for py, sy := range ys {
+			if sy < 0 {
+				continue
+			}
+			line := tmp[py*w : (py+1)*w]
+			for x := range line {
+				var sum float32
+				for i, c := range row {
+					if sx := xs[x+i]; sx >= 0 && c != 0 {
+						sum += float32(c) * pixel(sx, sy)
+					}
+				}
+				line[x] = sum
+			}
+		}
+		for y := 0; y < h; y++ {
+			line := out.Pix[y*out.Stride : y*out.Stride+w]
+			for i, c := range col {
+				if ys[y+i] < 0 || c == 0 {
+					continue
+				}
+				src := tmp[(y+i)*w : (y+i+1)*w]
+				for x, v := range src {
+					line[x] += float32(c) * v
+				}
+			}
+		}
+		return out
+	}
+
+	type coef struct {
+		x, y int
+		k    float32
+	}
+	coefs := []coef{}
+	for i, v := range k.Values {
+		if v != 0 {
+			coefs = append(coefs, coef{x: i % k.Width, y: i / k.Width, k: float32(v)})
+		}
+	}
+	for y := 0; y < h; y++ {
+		line := out.Pix[y*out.Stride : y*out.Stride+w]
+		for x := range line {
+			var sum float32
+			for _, c := range coefs {
+				sx, sy := xs[x+c.x], ys[y+c.y]
+				if sx >= 0 && sy >= 0 {
+					sum += c.k * pixel(sx, sy)
+				}
+			}
+			line[x] = sum
+		}
+	}
+	return out
+}
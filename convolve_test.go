@@ -0,0 +1,159 @@
+package main
+
+import (
+	"image"
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestBorderIndex(t *testing.T) {
+	// 3 samples before and after a line of 4
+	tests := []struct {
+		mode BorderMode
+		want []int
+	}{
+		{BorderReplicate, []int{0, 0, 0, 0, 1, 2, 3, 3, 3, 3}},
+		{BorderReflect, []int{3, 2, 1, 0, 1, 2, 3, 2, 1, 0}},
+		{BorderWrap, []int{1, 2, 3, 0, 1, 2, 3, 0, 1, 2}},
+		{BorderZero, []int{-1, -1, -1, 0, 1, 2, 3, -1, -1, -1}},
+	}
+	for _, tt := range tests {
+		if got := borderIndex(4, 3, 3, tt.mode); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: %v, want %v", tt.mode, got, tt.want)
+		}
+	}
+
+	// a kernel wider than the image
+	if got, want := borderIndex(2, 4, 1, BorderReflect), []int{0, 1, 0, 1, 0, 1, 0}; !reflect.DeepEqual(got, want) {
+		t.Errorf("reflect over 2 samples: %v, want %v", got, want)
+	}
+	if got, want := borderIndex(1, 2, 2, BorderReflect), []int{0, 0, 0, 0, 0}; !reflect.DeepEqual(got, want) {
+		t.Errorf("reflect over 1 sample: %v, want %v", got, want)
+	}
+	if got, want := borderIndex(3, 7, 0, BorderWrap), []int{2, 0, 1, 2, 0, 1, 2, 0, 1, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("wrap over 3 samples: %v, want %v", got, want)
+	}
+}
+
+func TestBorderModeByName(t *testing.T) {
+	for _, mode := range []BorderMode{BorderReplicate, BorderReflect, BorderWrap, BorderZero} {
+		if got, err := BorderModeByName(mode.String()); err != nil || got != mode {
+			t.Errorf("%v: got %v, %v", mode, got, err)
+		}
+	}
+	if _, err := BorderModeByName("mirror"); err == nil {
+		t.Error("mirror accepted")
+	}
+}
+
+// referenceSample is the pixel a kernel sees at (x, y), possibly beyond the
+// image, found by walking back into it rather than through borderIndex.
+func referenceSample(img *image.Gray, x, y int, mode BorderMode) float64 {
+	fold := func(v, n int) (int, bool) {
+		switch mode {
+		case BorderReplicate:
+			return int(math.Max(0, math.Min(float64(v), float64(n-1)))), true
+		case BorderReflect:
+			for n > 1 && (v < 0 || v >= n) {
+				if v < 0 {
+					v = -v
+				} else {
+					v = 2*(n-1) - v
+				}
+			}
+			if n == 1 {
+				v = 0
+			}
+			return v, true
+		case BorderWrap:
+			return ((v % n) + n) % n, true
+		}
+		return v, v >= 0 && v < n
+	}
+	sx, okx := fold(x, img.Rect.Dx())
+	sy, oky := fold(y, img.Rect.Dy())
+	if !okx || !oky {
+		return 0
+	}
+	return float64(img.Pix[sy*img.Stride+sx])
+}
+
+func referenceConvolve(img *image.Gray, k Kernel, mode BorderMode) []float64 {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	out := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var sum float64
+			for ky := 0; ky < k.Height; ky++ {
+				for kx := 0; kx < k.Width; kx++ {
+					sum += k.Values[ky*k.Width+kx] * referenceSample(img, x+kx-k.Width/2, y+ky-k.Height/2, mode)
+				}
+			}
+			out[y*w+x] = sum
+		}
+	}
+	return out
+}
+
+// TestConvolve checks the separable and the direct convolutions against a
+// plain one, in every border mode.
+func TestConvolve(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	random := make([]float64, 15)
+	for i := range random {
+		random[i] = rng.Float64()*2 - 1
+	}
+	kernels := []struct {
+		name      string
+		k         Kernel
+		separable bool
+	}{
+		{"sobel-h5", kernelBank["sobel-h5"], true},
+		{"sobel-v3", kernelBank["sobel-v3"], true},
+		{"box 3x3", Kernel{3, 3, []float64{1, 1, 1, 1, 1, 1, 1, 1, 1}}, true},
+		{"gaussian 5x3", Kernel{5, 3, []float64{1, 4, 6, 4, 1, 2, 8, 12, 8, 2, 1, 4, 6, 4, 1}}, true},
+		{"row 7x1", Kernel{7, 1, []float64{1, -2, 3, 0, -3, 2, -1}}, true},
+		{"laplacian", Kernel{3, 3, []float64{0, 1, 0, 1, -4, 1, 0, 1, 0}}, false},
+		{"random 5x3", Kernel{5, 3, random}, false},
+	}
+	for _, size := range []image.Point{{17, 11}, {2, 9}, {1, 1}} {
+		img := image.NewGray(image.Rect(0, 0, size.X, size.Y))
+		rng.Read(img.Pix)
+		for _, kk := range kernels {
+			if _, _, ok := kk.k.separable(); ok != kk.separable {
+				t.Errorf("%s: separable %v, want %v", kk.name, ok, kk.separable)
+			}
+			for _, mode := range []BorderMode{BorderReplicate, BorderReflect, BorderWrap, BorderZero} {
+				got := Convolve(img, kk.k, mode)
+				want := referenceConvolve(img, kk.k, mode)
+				for i, v := range want {
+					if math.Abs(float64(got.Pix[i])-v) > 1e-3*math.Max(1, math.Abs(v)) {
+						t.Errorf("%s on %v, %v: sample %d is %g, want %g", kk.name, size, mode, i, got.Pix[i], v)
+						break
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestKernelSetBorderParam(t *testing.T) {
+	s, err := kernelSetParam(map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.addParams(map[string]string{})["border"]; s.border != BorderReplicate || ok {
+		t.Errorf("default border %v, recorded %v", s.border, ok)
+	}
+	if s, err = kernelSetParam(map[string]string{"border": "wrap"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.addParams(map[string]string{})["border"]; s.border != BorderWrap || got != "wrap" {
+		t.Errorf("border %v, recorded %q", s.border, got)
+	}
+	if _, err := kernelSetParam(map[string]string{"border": "mirror"}); err == nil {
+		t.Error("border=mirror accepted")
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A LabelledImage is an image to test and the SOCOFing style label giving
+// its ground truth.
+type LabelledImage struct {
+	Path  string
+	Label string
+	Info  SampleInfo
+}
+
+// LoadLabelledImages lists the images of a directory, sorted by path.
+// Without a manifest every file below the directory is labelled from its own
+// name, and files which are not SOCOFing names are skipped. With a manifest,
+// a CSV file of `file,label` rows with paths relative to the directory, only
+// the listed files are used and the label names the print, e.g.
+//
+//	00000.bmp,64__M_Right_index_finger
+//
+// A manifest row with an invalid label, a file which does not exist or a
+// file listed twice is an error.
+func LoadLabelledImages(directory, manifest string, filter SampleFilter) ([]LabelledImage, error) {
+	images := []LabelledImage{}
+	add := func(path, label string) error {
+		info, err := ParseSampleName(label)
+		if err != nil {
+			return err
+		}
+		if filter.Match(info) {
+			images = append(images, LabelledImage{Path: path, Label: label, Info: info})
+		}
+		return nil
+	}
+
+	if manifest != "" {
+		rows, err := readManifest(manifest)
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			path := filepath.Join(directory, row.file)
+			if _, err := os.Stat(path); err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", manifest, row.line, err)
+			}
+			if err := add(path, row.label); err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", manifest, row.line, err)
+			}
+		}
+	} else {
+		err := filepath.WalkDir(directory, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() || isRawSidecar(d.Name()) {
+				return nil
+			}
+			label := strings.TrimSuffix(d.Name(), filepath.Ext(d.Name()))
+			if err := add(path, label); err != nil {
+				log.Printf("[!] Skipping %v\n", err)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Slice(images, func(i, j int) bool { return images[i].Path < images[j].Path })
+	return images, nil
+}
+
+// A manifestRow is a `file,label` row of a manifest and its line.
+type manifestRow struct {
+	line        int
+	file, label string
+}
+
+// readManifest returns the `file,label` rows of a manifest, without the
+// optional `file,label` header.
+func readManifest(manifest string) ([]manifestRow, error) {
+	f, err := os.Open(manifest)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = 2
+	r.TrimLeadingSpace = true
+	rows := []manifestRow{}
+	seen := map[string]int{}
+	for first := true; ; first = false {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", manifest, err)
+		}
+		if first && record[0] == "file" && record[1] == "label" {
+			continue
+		}
+		line, _ := r.FieldPos(0)
+		file := filepath.Clean(record[0])
+		if previous, ok := seen[file]; ok {
+			return nil, fmt.Errorf("%s:%d: %s is already listed on line %d", manifest, line, record[0], previous)
+		}
+		seen[file] = line
+		rows = append(rows, manifestRow{line: line, file: record[0], label: record[1]})
+	}
+	return rows, nil
+}
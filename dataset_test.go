@@ -0,0 +1,121 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// imageDir creates empty files below a temporary directory.
+func imageDir(t *testing.T, names ...string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func writeManifest(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "manifest.csv")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func labels(images []LabelledImage) []string {
+	out := []string{}
+	for _, image := range images {
+		out = append(out, image.Label)
+	}
+	return out
+}
+
+func TestLoadLabelledImagesFromNames(t *testing.T) {
+	dir := imageDir(t,
+		"Altered-Hard/2__F_Left_thumb_finger_Zcut.BMP",
+		"1__M_Right_index_finger.BMP",
+		"3__M_Left_ring_finger.raw",
+		"3__M_Left_ring_finger.hdr", // sidecar of the raw frame
+		"Thumbs.db",
+	)
+	images, err := LoadLabelledImages(dir, "", SampleFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"1__M_Right_index_finger", "3__M_Left_ring_finger", "2__F_Left_thumb_finger_Zcut"}
+	if got := labels(images); !reflect.DeepEqual(got, want) {
+		t.Errorf("labels %v, want %v", got, want)
+	}
+	if images[2].Info.Alteration != "Zcut" || images[2].Path != filepath.Join(dir, "Altered-Hard/2__F_Left_thumb_finger_Zcut.BMP") {
+		t.Errorf("image %+v", images[2])
+	}
+
+	images, err = LoadLabelledImages(dir, "", SampleFilter{"gender": "M"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := labels(images), []string{"1__M_Right_index_finger", "3__M_Left_ring_finger"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("gender=M: labels %v, want %v", got, want)
+	}
+}
+
+func TestLoadLabelledImagesFromManifest(t *testing.T) {
+	dir := imageDir(t, "00000.bmp", "00001.bmp", "sub/00002.bmp", "unlisted.bmp")
+	manifest := writeManifest(t, "file,label\n00001.bmp, 452__F_Left_index_finger\n00000.bmp,64__M_Right_index_finger\nsub/00002.bmp,64__M_Right_index_finger_CR\n")
+	images, err := LoadLabelledImages(dir, manifest, SampleFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []LabelledImage{
+		{filepath.Join(dir, "00000.bmp"), "64__M_Right_index_finger", SampleInfo{"64", "M", "Right", "index", ""}},
+		{filepath.Join(dir, "00001.bmp"), "452__F_Left_index_finger", SampleInfo{"452", "F", "Left", "index", ""}},
+		{filepath.Join(dir, "sub/00002.bmp"), "64__M_Right_index_finger_CR", SampleInfo{"64", "M", "Right", "index", "CR"}},
+	}
+	if !reflect.DeepEqual(images, want) {
+		t.Errorf("images %+v\nwant %+v", images, want)
+	}
+
+	// without the header, filtered
+	manifest = writeManifest(t, "00000.bmp,64__M_Right_index_finger\nsub/00002.bmp,64__M_Right_index_finger_CR\n")
+	images, err = LoadLabelledImages(dir, manifest, SampleFilter{"alteration": "none"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := labels(images); !reflect.DeepEqual(got, []string{"64__M_Right_index_finger"}) {
+		t.Errorf("alteration=none: labels %v", got)
+	}
+}
+
+func TestLoadLabelledImagesInvalidManifest(t *testing.T) {
+	dir := imageDir(t, "00000.bmp", "00001.bmp")
+	tests := []struct {
+		name, content, err string
+	}{
+		{"one column", "file,label\n00000.bmp\n", "wrong number of fields"},
+		{"three columns", "00000.bmp,64__M_Right_index_finger,extra\n", "wrong number of fields"},
+		{"invalid label", "file,label\n00000.bmp,64__M_Right_index_finger\n00001.bmp,subject 452\n", ":3: invalid SOCOFing name"},
+		{"missing file", "file,label\n00002.bmp,64__M_Right_index_finger\n", ":2: stat "},
+		{"duplicate row", "00000.bmp,64__M_Right_index_finger\n00001.bmp,452__F_Left_index_finger\n00000.bmp,64__M_Right_index_finger\n", ":3: 00000.bmp is already listed on line 1"},
+		{"same file, other spelling", "file,label\n00000.bmp,64__M_Right_index_finger\n./00000.bmp,452__F_Left_index_finger\n", ":3: ./00000.bmp is already listed on line 2"},
+	}
+	for _, tt := range tests {
+		_, err := LoadLabelledImages(dir, writeManifest(t, tt.content), SampleFilter{})
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: error %v, want one with %q", tt.name, err, tt.err)
+		}
+	}
+	if _, err := LoadLabelledImages(dir, filepath.Join(dir, "missing.csv"), SampleFilter{}); err == nil {
+		t.Error("missing manifest accepted")
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+var defaultDistance = "l2"
+
+// A DistanceFunc compares two feature vectors of the same length, 0 means
+// identical.
+type DistanceFunc func(a, b []float64) float64
+
+// metric distances satisfy the triangle inequality, which the vantage point
+// tree relies on to prune the gallery.
+var metricDistances = map[string]bool{
+	"l1": true,
+	"l2": true,
+}
+
+var distances = map[string]DistanceFunc{
+	"l1":           L1Distance,
+	"l2":           L2Distance,
+	"chi2":         ChiSquareDistance,
+	"intersection": IntersectionDistance,
+}
+
+func DistanceByName(name string) (DistanceFunc, error) {
+	distance, ok := distances[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown distance %q (available: %s)", name, strings.Join(DistanceNames(), ", "))
+	}
+	return distance, nil
+}
+
+func DistanceNames() []string {
+	names := []string{}
+	for name := range distances {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func L1Distance(a, b []float64) float64 {
+	var d float64
+	for i := range a {
+		d += math.Abs(a[i] - b[i])
+	}
+	return d
+}
+
+func L2Distance(a, b []float64) float64 {
+	var d float64
+	for i := range a {
+		d += (a[i] - b[i]) * (a[i] - b[i])
+	}
+	return math.Sqrt(d)
+}
+
+// ChiSquareDistance is meant for histograms: bins where both vectors are
+// empty do not count.
+func ChiSquareDistance(a, b []float64) float64 {
+	var d float64
+	for i := range a {
+		if s := a[i] + b[i]; s != 0 {
+			d += (a[i] - b[i]) * (a[i] - b[i]) / s
+		}
+	}
+	return d / 2
+}
+
+// IntersectionDistance is one minus the histogram intersection, normalised
+// by the smaller of the two histograms.
+func IntersectionDistance(a, b []float64) float64 {
+	var inter, sumA, sumB float64
+	for i := range a {
+		inter += math.Min(a[i], b[i])
+		sumA += a[i]
+		sumB += b[i]
+	}
+	norm := math.Min(sumA, sumB)
+	if norm <= 0 {
+		return 1
+	}
+	return 1 - inter/norm
+}
+
+// Similarity maps a distance to a score in (0, 1], 1 for identical features.
+func Similarity(distance float64) float64 {
+	return 1 / (1 + distance)
+}
+
+// A Neighbour is a template of the model and its distance to the probe.
+type Neighbour struct {
+	Index    int
+	Distance float64
+}
+
+// Vote picks the subject with the most templates among the neighbours, ties
+// go to the subject whose templates are closest in total.
+func Vote(templates []Template, neighbours []Neighbour) string {
+	votes := map[string]int{}
+	total := map[string]float64{}
+	for _, n := range neighbours {
+		id := templates[n.Index].SubjectID
+		votes[id]++
+		total[id] += n.Distance
+	}
+
+	var best string
+	for _, n := range neighbours {
+		id := templates[n.Index].SubjectID
+		if best == "" || votes[id] > votes[best] || (votes[id] == votes[best] && total[id] < total[best]) {
+			best = id
+		}
+	}
+	return best
+}
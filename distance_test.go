@@ -0,0 +1,68 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestDistances(t *testing.T) {
+	a, b := []float64{1, 2, 0, 3}, []float64{2, 0, 0, 1}
+	zero := []float64{0, 0, 0, 0}
+	tests := []struct {
+		name string
+		a, b []float64
+		want float64
+	}{
+		{"l1", a, b, 1 + 2 + 0 + 2},
+		{"l2", a, b, 3}, // sqrt(1 + 4 + 0 + 4)
+		// (1/3 + 4/2 + 4/4) / 2, the empty third bin left out
+		{"chi2", a, b, 5.0 / 3},
+		{"chi2", zero, zero, 0},
+		// 1 - (1 + 0 + 0 + 1) / min(6, 3)
+		{"intersection", a, b, 1.0 / 3},
+		{"intersection", b, []float64{4, 0, 0, 2}, 0}, // b is within the other
+		{"intersection", zero, a, 1},
+	}
+	for _, tt := range tests {
+		distance, err := DistanceByName(tt.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := distance(tt.a, tt.b); math.Abs(got-tt.want) > 1e-12 {
+			t.Errorf("%s(%v, %v) = %g, want %g", tt.name, tt.a, tt.b, got, tt.want)
+		}
+		if got, want := distance(tt.b, tt.a), distance(tt.a, tt.b); got != want {
+			t.Errorf("%s is not symmetric: %g and %g", tt.name, got, want)
+		}
+		if got := distance(a, a); got != 0 {
+			t.Errorf("%s of identical features is %g", tt.name, got)
+		}
+	}
+	if _, err := DistanceByName("cosine"); err == nil {
+		t.Error("unknown distance accepted")
+	}
+}
+
+func TestVote(t *testing.T) {
+	templates := []Template{{SubjectID: "a"}, {SubjectID: "b"}, {SubjectID: "a"}, {SubjectID: "b"}, {SubjectID: "c"}}
+	tests := []struct {
+		name       string
+		neighbours []Neighbour
+		want       string
+	}{
+		{"nearest", []Neighbour{{4, 0.5}}, "c"},
+		{"most templates", []Neighbour{{4, 0.5}, {0, 1}, {2, 3}}, "a"},
+		// a and b have 2 votes, b is closer in total: 1 + 2 against 2 + 3
+		{"tie, closer in total", []Neighbour{{1, 1}, {0, 2}, {3, 2}, {2, 3}}, "b"},
+		{"tie, closer in total, farther first", []Neighbour{{0, 1}, {2, 1}, {1, 0.5}, {3, 0.5}, {4, 9}}, "b"},
+		// same votes and total, the subject of the nearest template
+		{"full tie", []Neighbour{{0, 1}, {1, 1}}, "a"},
+		{"full tie, reversed", []Neighbour{{1, 1}, {0, 1}}, "b"},
+		{"nothing", nil, ""},
+	}
+	for _, tt := range tests {
+		if got := Vote(templates, tt.neighbours); got != tt.want {
+			t.Errorf("%s: %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
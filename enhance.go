@@ -0,0 +1,246 @@
+package main
+
+import (
+	"image"
+	"math"
+	"sort"
+)
+
+// The Gabor enhancement of Hong, Wan and Jain (1998): every pixel is
+// filtered by a Gabor kernel tuned to the orientation and the frequency of
+// the ridges around it, which joins broken ridges and smooths the noise
+// between them without blurring across ridges.
+const (
+	defaultGaborBlock = 8
+	defaultGaborSigma = 4.0
+
+	// ridge periods, in pixels, which count as a ridge frequency
+	minRidgePeriod = 3
+	maxRidgePeriod = 25
+
+	gaborAngles = 32 // orientations of the kernel bank, over π
+)
+
+// GaborEnhance returns img enhanced with the orientation field of gaborBlock
+// x gaborBlock blocks and the ridge frequency of its blocks, filtered by
+// Gabor kernels of sigma pixels. Ridges stay dark; the gray levels are
+// spread around 128 with the standard deviation of normalizeStd.
+func GaborEnhance(img *image.Gray, block int, sigma float64) *image.Gray {
+	normalized := NormalizeGray(img, normalizeMean, normalizeStd*normalizeStd)
+	field := EstimateOrientation(normalized, block, defaultOrientationSmooth)
+	return GaborFilter(normalized, field, RidgeFrequencies(normalized, field), sigma)
+}
+
+// RidgeFrequencies estimates the ridge frequency, in cycles per pixel, of
+// every block of the field: the gray levels of a window of 4 x 1 blocks
+// across the ridges are averaged along them into a signature which goes up
+// and down once per ridge. Blocks without a plausible period, such as
+// the background, a scar or the core, take the weighted average of their
+// neighbours, and the frequencies are smoothed.
+func RidgeFrequencies(img *image.Gray, field *OrientationField) []float64 {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	block := field.Block
+	pixel := func(x, y float64) float64 {
+		ix, iy := int(math.Floor(x+0.5)), int(math.Floor(y+0.5))
+		if ix < 0 {
+			ix = 0
+		} else if ix >= w {
+			ix = w - 1
+		}
+		if iy < 0 {
+			iy = 0
+		} else if iy >= h {
+			iy = h - 1
+		}
+		return float64(img.Pix[img.PixOffset(img.Rect.Min.X+ix, img.Rect.Min.Y+iy)])
+	}
+
+	freq := make([]float64, field.Width*field.Height)
+	valid := make([]float64, len(freq))
+	signature := make([]float64, 4*block)
+	for by := 0; by < field.Height; by++ {
+		for bx := 0; bx < field.Width; bx++ {
+			i := by*field.Width + bx
+			cx, cy := (float64(bx)+0.5)*float64(block), (float64(by)+0.5)*float64(block)
+			rx, ry := math.Cos(field.Angle[i]), math.Sin(field.Angle[i]) // along the ridges
+			nx, ny := -ry, rx                                            // across them
+			for k := range signature {
+				var sum float64
+				for d := 0; d < block; d++ {
+					u, v := float64(d)-float64(block)/2, float64(k)-float64(2*block)
+					sum += pixel(cx+u*rx+v*nx, cy+u*ry+v*ny)
+				}
+				signature[k] = sum / float64(block)
+			}
+			if period := signaturePeriod(signature); period >= minRidgePeriod && period <= maxRidgePeriod {
+				freq[i], valid[i] = 1/period, 1
+			}
+		}
+	}
+
+	// normalized convolution: the valid frequencies spread over the blocks
+	// around them, the others are ignored
+	weighted := make([]float64, len(freq))
+	for i := range freq {
+		weighted[i] = freq[i] * valid[i]
+	}
+	weighted = smoothBlocks(weighted, field.Width, field.Height, 1)
+	weights := smoothBlocks(valid, field.Width, field.Height, 1)
+	known := []float64{}
+	for i := range freq {
+		if valid[i] != 0 {
+			known = append(known, freq[i])
+		}
+	}
+	median := 0.0
+	if len(known) > 0 {
+		sort.Float64s(known)
+		median = known[len(known)/2]
+	}
+	for i := range freq {
+		if weights[i] > 1e-3 {
+			freq[i] = weighted[i] / weights[i]
+		} else {
+			freq[i] = median
+		}
+	}
+	return freq
+}
+
+// signaturePeriod returns the ridge period of a signature: it is smoothed,
+// then every time it crosses a band of a quarter of its standard deviation
+// around its mean, from a ridge to a valley or back, half a period has gone.
+// It is 0 without a whole period.
+func signaturePeriod(signature []float64) float64 {
+	smoothed := append([]float64{}, signature...)
+	for pass := 0; pass < 2; pass++ {
+		prev := smoothed[0]
+		for k := 1; k < len(smoothed)-1; k++ {
+			v := (prev + 2*smoothed[k] + smoothed[k+1]) / 4
+			prev, smoothed[k] = smoothed[k], v
+		}
+	}
+	var sum, ssq float64
+	for _, v := range smoothed {
+		sum += v
+		ssq += v * v
+	}
+	mean := sum / float64(len(smoothed))
+	band := math.Sqrt(math.Max(ssq/float64(len(smoothed))-mean*mean, 0)) / 4
+	if band == 0 {
+		return 0
+	}
+
+	crossings, above := []int{}, 0
+	for k, v := range smoothed {
+		switch {
+		case v > mean+band && above <= 0:
+			if above < 0 {
+				crossings = append(crossings, k)
+			}
+			above = 1
+		case v < mean-band && above >= 0:
+			if above > 0 {
+				crossings = append(crossings, k)
+			}
+			above = -1
+		}
+	}
+	// from a crossing to the last one in the same direction
+	n := len(crossings) - 1
+	n -= n % 2
+	if n < 2 {
+		return 0
+	}
+	return 2 * float64(crossings[n]-crossings[0]) / float64(n)
+}
+
+// GaborFilter filters every pixel of img with the even symmetric Gabor
+// kernel of the orientation and the frequency of its block, a cosine across
+// the ridges under a Gaussian envelope of sigma pixels, without its mean so
+// that a flat image gives 0. Blocks of frequency 0 are left flat. The
+// response is spread around 128 with a standard deviation of normalizeStd.
+func GaborFilter(img *image.Gray, field *OrientationField, freq []float64, sigma float64) *image.Gray {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	out := image.NewGray(img.Rect)
+	if w == 0 || h == 0 {
+		return out
+	}
+	radius := int(math.Ceil(3 * sigma))
+	xs := borderIndex(w, radius, radius, BorderReplicate)
+	ys := borderIndex(h, radius, radius, BorderReplicate)
+
+	var mean float64
+	grayPixels(img, func(p *uint8) { mean += float64(*p) })
+	mean /= float64(w * h)
+
+	type tuning struct{ angle, freq int }
+	kernels := map[tuning][]float64{}
+	response := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			i := (y/field.Block)*field.Width + x/field.Block
+			if freq[i] <= 0 {
+				continue
+			}
+			t := tuning{
+				angle: int(math.Round(field.Angle[i]/math.Pi*gaborAngles)) % gaborAngles,
+				freq:  int(math.Round(freq[i] * 1000)),
+			}
+			k, ok := kernels[t]
+			if !ok {
+				k = gaborKernel(float64(t.angle)*math.Pi/gaborAngles, float64(t.freq)/1000, sigma, radius)
+				kernels[t] = k
+			}
+			var sum float64
+			for ky := 0; ky <= 2*radius; ky++ {
+				row := img.Pix[img.PixOffset(img.Rect.Min.X, img.Rect.Min.Y+ys[y+ky]):]
+				kernelRow := k[ky*(2*radius+1):]
+				for kx := 0; kx <= 2*radius; kx++ {
+					sum += kernelRow[kx] * (float64(row[xs[x+kx]]) - mean)
+				}
+			}
+			response[y*w+x] = sum
+		}
+	}
+
+	var ssq float64
+	for _, r := range response {
+		ssq += r * r
+	}
+	scale := 0.0
+	if ssq > 0 {
+		scale = normalizeStd / math.Sqrt(ssq/float64(len(response)))
+	}
+	for y := 0; y < h; y++ {
+		row := out.Pix[out.PixOffset(img.Rect.Min.X, img.Rect.Min.Y+y):]
+		for x := 0; x < w; x++ {
+			row[x] = clampUint8(normalizeMean + scale*response[y*w+x])
+		}
+	}
+	return out
+}
+
+// gaborKernel returns the (2 radius + 1)² values of the Gabor kernel of
+// ridges of the orientation angle and the frequency freq, row by row.
+func gaborKernel(angle, freq, sigma float64, radius int) []float64 {
+	size := 2*radius + 1
+	k, envelope := make([]float64, size*size), make([]float64, size*size)
+	nx, ny := -math.Sin(angle), math.Cos(angle) // across the ridges
+	var sum, total float64
+	for y := -radius; y <= radius; y++ {
+		for x := -radius; x <= radius; x++ {
+			i := (y+radius)*size + x + radius
+			across := float64(x)*nx + float64(y)*ny
+			envelope[i] = math.Exp(-float64(x*x+y*y) / (2 * sigma * sigma))
+			k[i] = envelope[i] * math.Cos(2*math.Pi*freq*across)
+			sum += k[i]
+			total += envelope[i]
+		}
+	}
+	// the mean is taken out under the envelope
+	for i := range k {
+		k[i] -= sum / total * envelope[i]
+	}
+	return k
+}
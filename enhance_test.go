@@ -0,0 +1,59 @@
+package main
+
+import (
+	"image"
+	"math"
+	"testing"
+)
+
+func TestRidgeFrequencies(t *testing.T) {
+	r := image.Rect(0, 0, 96, 96)
+	for _, period := range []float64{6, 9, 12} {
+		for _, degrees := range []float64{0, 45, 100} {
+			img := stripes(r, degrees*math.Pi/180, period, 10, 1)
+			field := EstimateOrientation(img, 8, defaultOrientationSmooth)
+			freq := RidgeFrequencies(img, field)
+			if len(freq) != field.Width*field.Height {
+				t.Fatalf("%d frequencies for %d blocks", len(freq), field.Width*field.Height)
+			}
+			// the window of a block reaches 2 blocks across the ridges
+			for by := 2; by < field.Height-2; by++ {
+				for bx := 2; bx < field.Width-2; bx++ {
+					f := freq[by*field.Width+bx]
+					if math.Abs(f*period-1) > 0.1 {
+						t.Fatalf("period %g at %g°: block (%d, %d) has a frequency of %.4f, want %.4f", period, degrees, bx, by, f, 1/period)
+					}
+				}
+			}
+		}
+	}
+}
+
+// correlation is the Pearson correlation of the pixels of two images.
+func correlation(a, b *image.Gray) float64 {
+	var sa, sb, saa, sbb, sab float64
+	for i := range a.Pix {
+		x, y := float64(a.Pix[i]), float64(b.Pix[i])
+		sa, sb, saa, sbb, sab = sa+x, sb+y, saa+x*x, sbb+y*y, sab+x*y
+	}
+	n := float64(len(a.Pix))
+	return (sab/n - sa*sb/n/n) / math.Sqrt((saa/n-sa*sa/n/n)*(sbb/n-sb*sb/n/n))
+}
+
+func TestGaborEnhance(t *testing.T) {
+	r := image.Rect(4, -3, 4+96, -3+96)
+	clean := stripes(r, 0.6, 9, 0, 1)
+	noisy := stripes(r, 0.6, 9, 60, 2)
+	enhanced := GaborEnhance(noisy, defaultGaborBlock, defaultGaborSigma)
+	if enhanced.Rect != r {
+		t.Fatalf("bounds %v, want %v", enhanced.Rect, r)
+	}
+	// the ridges stay where they were, dark, with less noise around them
+	before, after := correlation(noisy, clean), correlation(enhanced, clean)
+	if after < 0.9 || after <= before {
+		t.Errorf("correlation with the clean ridges %.3f, %.3f before the enhancement", after, before)
+	}
+	if mean, std := meanStd(enhanced.Pix); math.Abs(mean-normalizeMean) > 8 || std < normalizeStd/2 {
+		t.Errorf("mean %g and std %g, want about %d and %d", mean, std, normalizeMean, normalizeStd)
+	}
+}
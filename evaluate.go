@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+)
+
+// ErrorRates are the verification error rates when accepting every score
+// at or above Threshold: FAR is the share of impostor comparisons accepted,
+// FRR the share of genuine comparisons rejected.
+type ErrorRates struct {
+	Threshold float64
+	FAR       float64
+	FRR       float64
+}
+
+// An Evaluation holds the similarity scores of genuine comparisons (probe
+// against its own subject) and impostor comparisons (against every other).
+type Evaluation struct {
+	Genuine  []float64
+	Impostor []float64
+}
+
+func (e *Evaluation) sort() {
+	sort.Float64s(e.Genuine)
+	sort.Float64s(e.Impostor)
+}
+
+// countBelow is the number of sorted scores strictly lower than t.
+func countBelow(sorted []float64, t float64) int {
+	return sort.SearchFloat64s(sorted, t)
+}
+
+func (e *Evaluation) RatesAt(t float64) ErrorRates {
+	e.sort()
+	return e.ratesAt(t)
+}
+
+func (e *Evaluation) ratesAt(t float64) ErrorRates {
+	rates := ErrorRates{Threshold: t}
+	if len(e.Impostor) > 0 {
+		rates.FAR = float64(len(e.Impostor)-countBelow(e.Impostor, t)) / float64(len(e.Impostor))
+	}
+	if len(e.Genuine) > 0 {
+		rates.FRR = float64(countBelow(e.Genuine, t)) / float64(len(e.Genuine))
+	}
+	return rates
+}
+
+// Curve returns the error rates at every distinct score, by increasing
+// threshold, then one threshold above every score where nothing is accepted.
+func (e *Evaluation) Curve() []ErrorRates {
+	e.sort()
+	thresholds := make([]float64, 0, len(e.Genuine)+len(e.Impostor)+1)
+	thresholds = append(thresholds, e.Genuine...)
+	thresholds = append(thresholds, e.Impostor...)
+	sort.Float64s(thresholds)
+
+	curve := []ErrorRates{}
+	for i, t := range thresholds {
+		if i > 0 && t == thresholds[i-1] {
+			continue
+		}
+		curve = append(curve, e.ratesAt(t))
+	}
+	if len(thresholds) > 0 {
+		last := thresholds[len(thresholds)-1]
+		curve = append(curve, e.ratesAt(math.Nextafter(last, math.Inf(1))))
+	}
+	return curve
+}
+
+// EER is the equal error rate: where FAR and FRR cross, the mean of the two
+// at the threshold which brings them closest.
+func EER(curve []ErrorRates) (eer float64, threshold float64) {
+	best := curve[0]
+	for _, r := range curve[1:] {
+		if math.Abs(r.FAR-r.FRR) < math.Abs(best.FAR-best.FRR) {
+			best = r
+		}
+	}
+	return (best.FAR + best.FRR) / 2, best.Threshold
+}
+
+// FNMRAt is the lowest FRR reachable while the FAR stays at or below far,
+// e.g. FMR100 for far = 0.01 and FMR1000 for far = 0.001.
+func FNMRAt(curve []ErrorRates, far float64) ErrorRates {
+	best := ErrorRates{FRR: 1}
+	found := false
+	for _, r := range curve {
+		if r.FAR <= far && (!found || r.FRR < best.FRR) {
+			best, found = r, true
+		}
+	}
+	return best
+}
+
+// WriteCurveCSV exports at most points rows of the curve, enough to plot the
+// ROC (far, tar) or the DET (far, frr) curve. The first and the last rows are
+// always kept, so points must be at least 2.
+func WriteCurveCSV(filepath string, curve []ErrorRates, points int) error {
+	if points < 2 {
+		return fmt.Errorf("a curve needs at least 2 points, got %d", points)
+	}
+	f, err := os.Create(filepath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	fmt.Fprintln(w, "threshold,far,frr,tar")
+	step := 1.0
+	if len(curve) > points {
+		step = float64(len(curve)-1) / float64(points-1)
+	}
+	last := -1
+	for p := 0.0; int(p+0.5) < len(curve); p += step {
+		i := int(p + 0.5)
+		if i == last {
+			continue
+		}
+		last = i
+		r := curve[i]
+		fmt.Fprintf(w, "%g,%g,%g,%g\n", r.Threshold, r.FAR, r.FRR, 1-r.FRR)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return f.Close()
+}
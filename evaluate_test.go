@@ -0,0 +1,120 @@
+package main
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCurve(t *testing.T) {
+	e := &Evaluation{
+		Genuine:  []float64{0.9, 0.6, 0.8},
+		Impostor: []float64{0.2, 0.7, 0.1, 0.3},
+	}
+	// accepting the scores at or above the threshold
+	want := []ErrorRates{
+		{0.1, 1, 0},
+		{0.2, 0.75, 0},
+		{0.3, 0.5, 0},
+		{0.6, 0.25, 0},
+		{0.7, 0.25, 1.0 / 3},
+		{0.8, 0, 1.0 / 3},
+		{0.9, 0, 2.0 / 3},
+		{math.Nextafter(0.9, 1), 0, 1},
+	}
+	curve := e.Curve()
+	if !reflect.DeepEqual(curve, want) {
+		t.Fatalf("curve %v\nwant %v", curve, want)
+	}
+	if got := e.RatesAt(0.65); got != (ErrorRates{0.65, 0.25, 1.0 / 3}) {
+		t.Errorf("rates at 0.65: %v", got)
+	}
+
+	if eer, threshold := EER(curve); math.Abs(eer-(0.25+1.0/3)/2) > 1e-12 || threshold != 0.7 {
+		t.Errorf("EER %g at %g, want %g at 0.7", eer, threshold, (0.25+1.0/3)/2)
+	}
+	tests := []struct {
+		far  float64
+		want ErrorRates
+	}{
+		{0.01, want[5]},  // FMR100
+		{0.001, want[5]}, // FMR1000
+		{0.25, want[3]},
+		{0.5, want[2]}, // the first threshold with the lowest FRR
+		{1, want[0]},
+	}
+	for _, tt := range tests {
+		if got := FNMRAt(curve, tt.far); got != tt.want {
+			t.Errorf("FNMR at FAR %g: %v, want %v", tt.far, got, tt.want)
+		}
+	}
+}
+
+func TestCurveTies(t *testing.T) {
+	e := &Evaluation{Genuine: []float64{0.5, 0.5}, Impostor: []float64{0.5}}
+	want := []ErrorRates{{0.5, 1, 0}, {math.Nextafter(0.5, 1), 0, 1}}
+	curve := e.Curve()
+	if !reflect.DeepEqual(curve, want) {
+		t.Fatalf("curve %v, want %v", curve, want)
+	}
+	if eer, threshold := EER(curve); eer != 0.5 || threshold != 0.5 {
+		t.Errorf("EER %g at %g", eer, threshold)
+	}
+	// no threshold keeps the FAR under 1% but the one rejecting everything
+	if got := FNMRAt(curve, 0.01); got != want[1] {
+		t.Errorf("FMR100 %v", got)
+	}
+}
+
+func TestWriteCurveCSV(t *testing.T) {
+	curve := make([]ErrorRates, 10)
+	for i := range curve {
+		curve[i] = ErrorRates{Threshold: float64(i), FAR: 1 - float64(i)/9, FRR: float64(i) / 9}
+	}
+	path := filepath.Join(t.TempDir(), "roc.csv")
+	tests := []struct {
+		points     int
+		thresholds string
+	}{
+		{2, "0 9"},
+		{4, "0 3 6 9"},
+		{10, "0 1 2 3 4 5 6 7 8 9"},
+		{1000, "0 1 2 3 4 5 6 7 8 9"},
+	}
+	for _, tt := range tests {
+		if err := WriteCurveCSV(path, curve, tt.points); err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(mustRead(t, path)), "\n")
+		if lines[0] != "threshold,far,frr,tar" {
+			t.Errorf("header %q", lines[0])
+		}
+		thresholds := []string{}
+		for _, line := range lines[1:] {
+			thresholds = append(thresholds, strings.Split(line, ",")[0])
+		}
+		if got := strings.Join(thresholds, " "); got != tt.thresholds {
+			t.Errorf("%d points: thresholds %s, want %s", tt.points, got, tt.thresholds)
+		}
+	}
+	if got := strings.Split(strings.TrimSpace(mustRead(t, path)), "\n")[4]; got != "3,0.6666666666666667,0.3333333333333333,0.6666666666666667" {
+		t.Errorf("row %q", got)
+	}
+	for _, points := range []int{1, 0, -5} {
+		if err := WriteCurveCSV(path, curve, points); err == nil {
+			t.Errorf("%d points accepted", points)
+		}
+	}
+}
+
+func mustRead(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var defaultExtractor = "sobel-histogram"
+
+// A FeatureExtractor turns a fingerprint image into the feature vector stored
+// in the model. Its name and parameters are saved with the model, so that an
+// image is always tested with the same settings the gallery was trained with.
+type FeatureExtractor interface {
+	Name() string
+	Params() map[string]string
+	// Dim is the length of the vectors returned by Extract.
+	Dim() int
+	Extract(img image.Image) ([]float64, error)
+}
+
+// an extractor factory receives the user supplied parameters, unset ones
+// take their default value.
+type extractorFactory func(params map[string]string) (FeatureExtractor, error)
+
+var extractors = map[string]extractorFactory{}
+
+func RegisterExtractor(name string, factory extractorFactory) {
+	if _, ok := extractors[name]; ok {
+		panic(fmt.Sprintf("extractor %q registered twice", name))
+	}
+	extractors[name] = factory
+}
+
+func NewExtractor(name string, params map[string]string) (FeatureExtractor, error) {
+	factory, ok := extractors[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown extractor %q (available: %s)", name, strings.Join(ExtractorNames(), ", "))
+	}
+	return factory(params)
+}
+
+func ExtractorNames() []string {
+	names := []string{}
+	for name := range extractors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// formatParams renders parameters as sorted `key=value` pairs.
+func formatParams(params map[string]string) string {
+	keys := []string{}
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := []string{}
+	for _, k := range keys {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", k, params[k]))
+	}
+	return strings.Join(pairs, " ")
+}
+
+func parseParam(pair string) (string, string, error) {
+	kv := strings.SplitN(pair, "=", 2)
+	if len(kv) != 2 || kv[0] == "" {
+		return "", "", fmt.Errorf("invalid parameter %q, expected key=value", pair)
+	}
+	return kv[0], kv[1], nil
+}
+
+func sameParams(a, b map[string]string) bool {
+	return formatParams(a) == formatParams(b)
+}
+
+// paramFlags collects repeated `-param key=value` command line flags.
+type paramFlags map[string]string
+
+func (p paramFlags) String() string {
+	return formatParams(p)
+}
+
+func (p paramFlags) Set(pair string) error {
+	k, v, err := parseParam(pair)
+	if err != nil {
+		return err
+	}
+	p[k] = v
+	return nil
+}
+
+func floatParam(params map[string]string, key string, def float64) (float64, error) {
+	v, ok := params[key]
+	if !ok {
+		return def, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, fmt.Errorf("parameter %s: %v", key, err)
+	}
+	return f, nil
+}
+
+func intParam(params map[string]string, key string, def int) (int, error) {
+	v, ok := params[key]
+	if !ok {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("parameter %s: %v", key, err)
+	}
+	return n, nil
+}
+
+func checkParams(name string, params map[string]string, known ...string) error {
+	for k := range params {
+		found := false
+		for _, kk := range known {
+			if k == kk {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("extractor %s has no parameter %q", name, k)
+		}
+	}
+	return nil
+}
+
+func init() {
+	RegisterExtractor("sobel-histogram", newSobelHistogramExtractor)
+	RegisterExtractor("sobel-topn", newSobelTopNExtractor)
+	RegisterExtractor("sobel-hist256", newSobelHist256Extractor)
+}
+
+// sobelPipeline is the common start of the Sobel extractors:
+// gray scale -> preprocessing -> Sobel -> clamped to [0, 255], one image per
+// output of the kernel set, of which the extractors only see the pixels on
+// the foreground found by the segmentation.
+type sobelPipeline struct {
+	segment    *segmentation
+	preprocess *preprocessing
+	kernels    *kernelSet
+}
+
+func (p *sobelPipeline) pixels(img image.Image) ([][]uint8, error) {
+	// 1. Convert normal image into GrayScale image.
+	grayImg, err := toGrayScale(img)
+	if err != nil {
+		return nil, err
+	}
+
+	// 2. Find the print, on the gray levels as scanned
+	mask := p.segment.apply(grayImg)
+
+	// 3. Even out its contrast
+	grayImg = p.preprocess.apply(grayImg)
+
+	// 4. Apply the `Sobel Operator` kernels on image matrix
+	sobelImgGrays := p.kernels.apply(grayImg)
+	pixels := make([][]uint8, len(sobelImgGrays))
+	for i, sobelImgGray := range sobelImgGrays {
+		pixels[i] = maskedPixels(sobelImgGray, mask)
+	}
+	return pixels, nil
+}
+
+func (p *sobelPipeline) addParams(params map[string]string) map[string]string {
+	return p.kernels.addParams(p.preprocess.addParams(p.segment.addParams(params)))
+}
+
+// outputs is the number of pixel sets pixels returns.
+func (p *sobelPipeline) outputs() int {
+	return p.kernels.outputs()
+}
+
+// formatKernel renders the values of a convolution kernel.
+func formatKernel(kernel []float64) string {
+	values := make([]string, len(kernel))
+	for i, v := range kernel {
+		values[i] = strconv.FormatFloat(v, 'g', -1, 64)
+	}
+	return strings.Join(values, ",")
+}
+
+// sobelParams checks the parameters of a Sobel extractor and reads its
+// segmentation, preprocessing and kernel set.
+func sobelParams(name string, params map[string]string, known ...string) (*sobelPipeline, error) {
+	known = append([]string{"kernel", "kernels", "combine", "border", "preprocess", "claheTiles", "claheClip", "gaborBlock", "gaborSigma", "segment", "segmentBlock", "segmentThreshold"}, known...)
+	if err := checkParams(name, params, known...); err != nil {
+		return nil, err
+	}
+	segment, err := segmentParam(params)
+	if err != nil {
+		return nil, err
+	}
+	preprocess, err := preprocessParam(params)
+	if err != nil {
+		return nil, err
+	}
+	kernels, err := kernelSetParam(params)
+	if err != nil {
+		return nil, err
+	}
+	return &sobelPipeline{segment: segment, preprocess: preprocess, kernels: kernels}, nil
+}
+
+func digestLenParam(name string, params map[string]string, known ...string) (int, *sobelPipeline, error) {
+	sobel, err := sobelParams(name, params, append([]string{"digestLen"}, known...)...)
+	if err != nil {
+		return 0, nil, err
+	}
+	n, err := intParam(params, "digestLen", digestLen)
+	if err != nil {
+		return 0, nil, err
+	}
+	if n < 1 || n > 255 {
+		return 0, nil, fmt.Errorf("parameter digestLen must be within [1, 255], got %d", n)
+	}
+	return n, sobel, nil
+}
+
+// sobelHistogramExtractor is the original pipeline: the top pixels of the
+// Sobel histogram multiplied into a single digest.
+type sobelHistogramExtractor struct {
+	digestLen  int
+	digestBase float64
+	sobel      *sobelPipeline
+}
+
+func newSobelHistogramExtractor(params map[string]string) (FeatureExtractor, error) {
+	n, sobel, err := digestLenParam("sobel-histogram", params, "digestBase")
+	if err != nil {
+		return nil, err
+	}
+	base, err := floatParam(params, "digestBase", digestBase)
+	if err != nil {
+		return nil, err
+	}
+	return &sobelHistogramExtractor{digestLen: n, digestBase: base, sobel: sobel}, nil
+}
+
+func (e *sobelHistogramExtractor) Name() string {
+	return "sobel-histogram"
+}
+
+func (e *sobelHistogramExtractor) Params() map[string]string {
+	return e.sobel.addParams(map[string]string{
+		"digestLen":  strconv.Itoa(e.digestLen),
+		"digestBase": strconv.FormatFloat(e.digestBase, 'g', -1, 64),
+	})
+}
+
+func (e *sobelHistogramExtractor) Dim() int {
+	return e.sobel.outputs()
+}
+
+func (e *sobelHistogramExtractor) Extract(img image.Image) ([]float64, error) {
+	sobelPixels, err := e.sobel.pixels(img)
+	if err != nil {
+		return nil, err
+	}
+	feature := make([]float64, 0, e.Dim())
+	for _, pixels := range sobelPixels {
+		top_pixel_values, top_frequencies := PixelFrequencyDistribution(pixels, e.digestLen)
+		feature = append(feature, digestFrequencyDistribution(top_pixel_values, top_frequencies, e.digestBase))
+	}
+	return feature, nil
+}
+
+// sobelTopNExtractor keeps the top pixels of the Sobel histogram as they are:
+// (pixel/255, frequency/non zero pixels) pairs, most frequent first.
+type sobelTopNExtractor struct {
+	digestLen int
+	sobel     *sobelPipeline
+}
+
+func newSobelTopNExtractor(params map[string]string) (FeatureExtractor, error) {
+	n, sobel, err := digestLenParam("sobel-topn", params)
+	if err != nil {
+		return nil, err
+	}
+	return &sobelTopNExtractor{digestLen: n, sobel: sobel}, nil
+}
+
+func (e *sobelTopNExtractor) Name() string {
+	return "sobel-topn"
+}
+
+func (e *sobelTopNExtractor) Params() map[string]string {
+	return e.sobel.addParams(map[string]string{
+		"digestLen": strconv.Itoa(e.digestLen),
+	})
+}
+
+func (e *sobelTopNExtractor) Dim() int {
+	return 2 * e.digestLen * e.sobel.outputs()
+}
+
+func (e *sobelTopNExtractor) Extract(img image.Image) ([]float64, error) {
+	sobelPixels, err := e.sobel.pixels(img)
+	if err != nil {
+		return nil, err
+	}
+	feature := make([]float64, 0, e.Dim())
+	for _, pixels := range sobelPixels {
+		var nonZero float64
+		for _, p := range pixels {
+			if p != 0 {
+				nonZero++
+			}
+		}
+		if nonZero == 0 {
+			nonZero = 1
+		}
+
+		top_pixel_values, top_frequencies := PixelFrequencyDistribution(pixels, e.digestLen)
+		for i := range top_pixel_values {
+			feature = append(feature, float64(top_pixel_values[i])/255, float64(top_frequencies[i])/nonZero)
+		}
+	}
+	return feature, nil
+}
+
+// sobelHist256Extractor is the whole Sobel histogram, normalised to sum to 1.
+type sobelHist256Extractor struct {
+	sobel *sobelPipeline
+}
+
+func newSobelHist256Extractor(params map[string]string) (FeatureExtractor, error) {
+	sobel, err := sobelParams("sobel-hist256", params)
+	if err != nil {
+		return nil, err
+	}
+	return &sobelHist256Extractor{sobel: sobel}, nil
+}
+
+func (e *sobelHist256Extractor) Name() string {
+	return "sobel-hist256"
+}
+
+func (e *sobelHist256Extractor) Params() map[string]string {
+	return e.sobel.addParams(map[string]string{})
+}
+
+func (e *sobelHist256Extractor) Dim() int {
+	return 256 * e.sobel.outputs()
+}
+
+func (e *sobelHist256Extractor) Extract(img image.Image) ([]float64, error) {
+	sobelPixels, err := e.sobel.pixels(img)
+	if err != nil {
+		return nil, err
+	}
+	feature := make([]float64, 0, e.Dim())
+	for _, pixels := range sobelPixels {
+		histogram := make([]float64, 256)
+		for _, p := range pixels {
+			histogram[p]++
+		}
+		if n := float64(len(pixels)); n > 0 {
+			for i := range histogram {
+				histogram[i] /= n
+			}
+		}
+		feature = append(feature, histogram...)
+	}
+	return feature, nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+)
+
+var defaultMaxFailureRate = 0.05
+
+// A FileFailure is an image which could not be processed, and why. Err
+// mentions the path, as the errors of loadImageFile do.
+type FileFailure struct {
+	Path string
+	Err  error
+}
+
+// A FailureReport counts the images of a run and keeps the ones which failed,
+// so that a few unreadable files are skipped instead of aborting the run.
+type FailureReport struct {
+	Total    int
+	Failures []FileFailure
+}
+
+func (r *FailureReport) Add(path string, err error) {
+	r.Failures = append(r.Failures, FileFailure{Path: path, Err: err})
+}
+
+func (r *FailureReport) Rate() float64 {
+	if r.Total == 0 {
+		return 0
+	}
+	return float64(len(r.Failures)) / float64(r.Total)
+}
+
+// Log lists every failed file, by path.
+func (r *FailureReport) Log() {
+	if len(r.Failures) == 0 {
+		return
+	}
+	sort.SliceStable(r.Failures, func(i, j int) bool { return r.Failures[i].Path < r.Failures[j].Path })
+	log.Printf("[!] %d/%d files failed:\n", len(r.Failures), r.Total)
+	for _, f := range r.Failures {
+		log.Printf("[!]   %v\n", f.Err)
+	}
+}
+
+// Check fails when there was no file, when more than maxRate of the files
+// failed, or all of them.
+func (r *FailureReport) Check(maxRate float64) error {
+	if r.Total == 0 {
+		return fmt.Errorf("no image to process")
+	}
+	if len(r.Failures) == r.Total {
+		return fmt.Errorf("all %d files failed", r.Total)
+	}
+	if r.Rate() > maxRate {
+		return fmt.Errorf("%d/%d files failed (%.2f%%), more than the limit of %.2f%%",
+			len(r.Failures), r.Total, 100*r.Rate(), 100*maxRate)
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestFailureReportCheck(t *testing.T) {
+	report := func(total, failed int) *FailureReport {
+		r := &FailureReport{Total: total}
+		for i := 0; i < failed; i++ {
+			r.Add("file.bmp", errors.New("unreadable"))
+		}
+		return r
+	}
+	tests := []struct {
+		total, failed int
+		maxRate       float64
+		ok            bool
+	}{
+		{0, 0, 0.05, false}, // nothing to train or test on
+		{10, 0, 0.05, true},
+		{100, 5, 0.05, true},
+		{100, 6, 0.05, false},
+		{3, 3, 1, false}, // all failed, whatever the limit
+		{3, 2, 1, true},
+	}
+	for _, tt := range tests {
+		err := report(tt.total, tt.failed).Check(tt.maxRate)
+		if (err == nil) != tt.ok {
+			t.Errorf("%d/%d failed, limit %g: error %v", tt.failed, tt.total, tt.maxRate, err)
+		}
+	}
+}
@@ -2,7 +2,4 @@ module example.com/biomego
 
 go 1.19
 
-require (
-	github.com/disintegration/imaging v1.6.2
-	golang.org/x/image v0.1.0
-)
+require golang.org/x/image v0.1.0
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"image"
+	"image/color"
+)
+
+// The fast paths of toGrayScale read the pixel buffers directly. They keep
+// the bounds of the source, which do not always start at (0, 0), e.g. for a
+// SubImage, and compute the luma exactly as color.GrayModel does, on 16-bit
+// premultiplied components.
+
+func grayLuma(r, g, b uint32) uint8 {
+	return uint8((19595*r + 38470*g + 7471*b + 1<<15) >> 24)
+}
+
+func grayFromGray(img *image.Gray) *image.Gray {
+	grayImg := image.NewGray(img.Rect)
+	width := img.Rect.Dx()
+	for y := img.Rect.Min.Y; y < img.Rect.Max.Y; y++ {
+		src := img.Pix[img.PixOffset(img.Rect.Min.X, y):]
+		dst := grayImg.Pix[grayImg.PixOffset(img.Rect.Min.X, y):]
+		copy(dst[:width], src[:width])
+	}
+	return grayImg
+}
+
+func grayFromRGBA(img *image.RGBA) *image.Gray {
+	grayImg := image.NewGray(img.Rect)
+	width := img.Rect.Dx()
+	for y := img.Rect.Min.Y; y < img.Rect.Max.Y; y++ {
+		src := img.Pix[img.PixOffset(img.Rect.Min.X, y):]
+		dst := grayImg.Pix[grayImg.PixOffset(img.Rect.Min.X, y):]
+		for x := 0; x < width; x++ {
+			p := src[4*x : 4*x+3]
+			dst[x] = grayLuma(uint32(p[0])*0x101, uint32(p[1])*0x101, uint32(p[2])*0x101)
+		}
+	}
+	return grayImg
+}
+
+// grayFromNRGBA premultiplies by alpha first, as NRGBA.RGBA does.
+func grayFromNRGBA(img *image.NRGBA) *image.Gray {
+	grayImg := image.NewGray(img.Rect)
+	width := img.Rect.Dx()
+	for y := img.Rect.Min.Y; y < img.Rect.Max.Y; y++ {
+		src := img.Pix[img.PixOffset(img.Rect.Min.X, y):]
+		dst := grayImg.Pix[grayImg.PixOffset(img.Rect.Min.X, y):]
+		for x := 0; x < width; x++ {
+			p := src[4*x : 4*x+4]
+			r, g, b := uint32(p[0])*0x101, uint32(p[1])*0x101, uint32(p[2])*0x101
+			if a := uint32(p[3]) * 0x101; a != 0xffff {
+				r, g, b = r*a/0xffff, g*a/0xffff, b*a/0xffff
+			}
+			dst[x] = grayLuma(r, g, b)
+		}
+	}
+	return grayImg
+}
+
+// grayFromPaletted converts the palette once; indexes beyond it, which
+// Paletted.At panics on, are black.
+func grayFromPaletted(img *image.Paletted) *image.Gray {
+	var lut [256]uint8
+	for i, c := range img.Palette {
+		if i < len(lut) {
+			lut[i] = color.GrayModel.Convert(c).(color.Gray).Y
+		}
+	}
+	grayImg := image.NewGray(img.Rect)
+	width := img.Rect.Dx()
+	for y := img.Rect.Min.Y; y < img.Rect.Max.Y; y++ {
+		src := img.Pix[img.PixOffset(img.Rect.Min.X, y):]
+		dst := grayImg.Pix[grayImg.PixOffset(img.Rect.Min.X, y):]
+		for x := 0; x < width; x++ {
+			dst[x] = lut[src[x]]
+		}
+	}
+	return grayImg
+}
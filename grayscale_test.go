@@ -0,0 +1,108 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+)
+
+// grayPalette has the 256 gray levels, as the 8-bit BMP of SOCOFing.
+func grayPalette() color.Palette {
+	p := make(color.Palette, 256)
+	for i := range p {
+		p[i] = color.Gray{Y: uint8(i)}
+	}
+	return p
+}
+
+// fastPathImages returns random pixels of bounds stored as each image type
+// toGrayScale converts directly; the NRGBA and RGBA ones have transparent
+// pixels, and the palette has colors.
+func fastPathImages(bounds image.Rectangle, seed int64) []image.Image {
+	rng := rand.New(rand.NewSource(seed))
+	palette := grayPalette()
+	for i := 0; i < 64; i++ {
+		palette[rng.Intn(len(palette))] = color.RGBA{uint8(rng.Intn(256)), uint8(rng.Intn(256)), uint8(rng.Intn(256)), 255}
+	}
+	gray := image.NewGray(bounds)
+	rgba := image.NewRGBA(bounds)
+	nrgba := image.NewNRGBA(bounds)
+	paletted := image.NewPaletted(bounds, palette)
+	rng.Read(gray.Pix)
+	rng.Read(nrgba.Pix)
+	rng.Read(paletted.Pix)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			// a valid premultiplied color, from the NRGBA one
+			rgba.Set(x, y, nrgba.At(x, y))
+		}
+	}
+	return []image.Image{gray, rgba, nrgba, paletted}
+}
+
+type subImager interface {
+	SubImage(r image.Rectangle) image.Image
+}
+
+func TestToGrayScaleFastPaths(t *testing.T) {
+	for _, bounds := range []image.Rectangle{
+		image.Rect(0, 0, 37, 23),
+		image.Rect(-5, 7, 30, 40), // an origin other than (0, 0)
+	} {
+		for _, img := range fastPathImages(bounds, 1) {
+			samples := []image.Image{img, img.(subImager).SubImage(image.Rect(3, 11, 20, 19))}
+			for _, sample := range samples {
+				fast, err := toGrayScale(sample)
+				if err != nil {
+					t.Fatal(err)
+				}
+				slow := toGrayScaleGeneric(sample)
+				if fast.Rect != slow.Rect {
+					t.Errorf("%T of %v: bounds %v, want %v", sample, sample.Bounds(), fast.Rect, slow.Rect)
+					continue
+				}
+				for y := slow.Rect.Min.Y; y < slow.Rect.Max.Y; y++ {
+					for x := slow.Rect.Min.X; x < slow.Rect.Max.X; x++ {
+						if f, s := fast.GrayAt(x, y), slow.GrayAt(x, y); f != s {
+							t.Fatalf("%T of %v: pixel (%d, %d) is %d, color.GrayModel gives %d", sample, sample.Bounds(), x, y, f.Y, s.Y)
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+// TestToGrayScalePalettedIndex checks that the indexes beyond a short
+// palette, which Paletted.At panics on, are black.
+func TestToGrayScalePalettedIndex(t *testing.T) {
+	img := image.NewPaletted(image.Rect(0, 0, 3, 1), color.Palette{color.White})
+	img.Pix = []uint8{0, 1, 255}
+	gray, err := toGrayScale(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []uint8{255, 0, 0}; string(gray.Pix) != string(want) {
+		t.Errorf("pixels %v, want %v", gray.Pix, want)
+	}
+}
+
+func benchmarkToGrayScale(b *testing.B, i int) {
+	img := fastPathImages(image.Rect(0, 0, 96, 103), 1)[i]
+	b.Run("fast", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			toGrayScale(img)
+		}
+	})
+	b.Run("generic", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			toGrayScaleGeneric(img)
+		}
+	})
+}
+
+func BenchmarkToGrayScaleGray(b *testing.B)     { benchmarkToGrayScale(b, 0) }
+func BenchmarkToGrayScaleRGBA(b *testing.B)     { benchmarkToGrayScale(b, 1) }
+func BenchmarkToGrayScaleNRGBA(b *testing.B)    { benchmarkToGrayScale(b, 2) }
+func BenchmarkToGrayScalePaletted(b *testing.B) { benchmarkToGrayScale(b, 3) }
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	_ "image/jpeg"
+	_ "image/png"
+
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+)
+
+// Images are decoded by image.Decode, which recognises BMP, PNG, JPEG, TIFF
+// and PGM from their first bytes. Raw 8-bit frames have no header, they are
+// read when the content is none of those and a sidecar with the same name
+// and the `.hdr` extension gives their size:
+//
+//	width=256 height=288
+const rawSidecarExt = ".hdr"
+
+// maxImagePixels bounds the size an image header may claim, 8192 x 8192
+// pixels, so that a corrupted or forged header is refused instead of
+// allocating gigabytes.
+const maxImagePixels = 1 << 26
+
+// checkImageSize returns an error when width x height is beyond
+// maxImagePixels.
+func checkImageSize(format string, width, height int) error {
+	if width > maxImagePixels || height > maxImagePixels/width {
+		return fmt.Errorf("%s: %dx%d image is too large", format, width, height)
+	}
+	return nil
+}
+
+func init() {
+	image.RegisterFormat("pgm", "P5", decodePGM, decodePGMConfig)
+	image.RegisterFormat("pgm", "P2", decodePGM, decodePGMConfig)
+}
+
+// readImage decodes an image whatever its format, path locates the sidecar
+// of raw frames. A frame with a sidecar is read raw when it does not decode
+// otherwise, even if its first pixels happen to look like a known header.
+func readImage(r io.ReadSeeker, path string) (image.Image, string, error) {
+	img, format, err := image.Decode(bufio.NewReader(r))
+	if err == nil {
+		return img, format, nil
+	}
+	width, height, sidecarErr := readRawSidecar(rawSidecarPath(path))
+	if os.IsNotExist(sidecarErr) {
+		if err == image.ErrFormat {
+			return nil, "", fmt.Errorf("unknown image format, and no %s sidecar for a raw frame", rawSidecarExt)
+		}
+		return nil, "", err
+	}
+	if sidecarErr != nil {
+		return nil, "", sidecarErr
+	}
+	// the size of the frame is checked before its pixels are allocated
+	size, err := r.Seek(0, io.SeekEnd)
+	if err == nil {
+		_, err = r.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if size != int64(width)*int64(height) {
+		return nil, "", fmt.Errorf("raw frame of %d bytes, its sidecar gives %dx%d", size, width, height)
+	}
+	img, err = readRawImage(bufio.NewReader(r), width, height)
+	return img, "raw", err
+}
+
+func rawSidecarPath(path string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + rawSidecarExt
+}
+
+// isRawSidecar tells the sidecars apart from the images of a directory.
+func isRawSidecar(name string) bool {
+	return strings.EqualFold(filepath.Ext(name), rawSidecarExt)
+}
+
+// readRawSidecar reads the `width=W height=H` pairs of a sidecar, separated
+// by spaces or new lines; `#` starts a comment.
+func readRawSidecar(path string) (int, int, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	size := map[string]int{}
+	for _, line := range strings.Split(string(content), "\n") {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		for _, pair := range strings.Fields(line) {
+			k, v, err := parseParam(pair)
+			if err != nil {
+				return 0, 0, fmt.Errorf("%s: %v", path, err)
+			}
+			if k != "width" && k != "height" {
+				return 0, 0, fmt.Errorf("%s: unknown setting %q, expected width and height", path, k)
+			}
+			if size[k], err = strconv.Atoi(v); err != nil || size[k] < 1 {
+				return 0, 0, fmt.Errorf("%s: invalid %s %q", path, k, v)
+			}
+		}
+	}
+	if size["width"] == 0 || size["height"] == 0 {
+		return 0, 0, fmt.Errorf("%s: expected width=W height=H", path)
+	}
+	if err := checkImageSize(path, size["width"], size["height"]); err != nil {
+		return 0, 0, err
+	}
+	return size["width"], size["height"], nil
+}
+
+// readRawImage reads a frame of width*height 8-bit pixels, row by row.
+func readRawImage(r io.Reader, width, height int) (*image.Gray, error) {
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	if _, err := io.ReadFull(r, img.Pix); err != nil {
+		return nil, fmt.Errorf("raw frame shorter than %dx%d: %v", width, height, err)
+	}
+	if n, _ := io.Copy(io.Discard, r); n > 0 {
+		return nil, fmt.Errorf("raw frame has %d bytes more than %dx%d", n, width, height)
+	}
+	return img, nil
+}
+
+// pgmHeader is the `P5 width height maxval` header of a Netpbm gray map.
+type pgmHeader struct {
+	binary        bool
+	width, height int
+	maxval        int
+}
+
+func readPGMHeader(br *bufio.Reader) (pgmHeader, error) {
+	h := pgmHeader{}
+	magic, err := pgmToken(br)
+	if err != nil {
+		return h, err
+	}
+	switch magic {
+	case "P5":
+		h.binary = true
+	case "P2":
+	default:
+		return h, fmt.Errorf("pgm: invalid magic %q", magic)
+	}
+	values := [3]int{}
+	for i := range values {
+		token, err := pgmToken(br)
+		if err != nil {
+			return h, err
+		}
+		if values[i], err = strconv.Atoi(token); err != nil || values[i] < 1 {
+			return h, fmt.Errorf("pgm: invalid header value %q", token)
+		}
+	}
+	h.width, h.height, h.maxval = values[0], values[1], values[2]
+	if h.maxval > 65535 {
+		return h, fmt.Errorf("pgm: maxval %d is above 65535", h.maxval)
+	}
+	if err := checkImageSize("pgm", h.width, h.height); err != nil {
+		return h, err
+	}
+	// a single white space separates the header from binary pixels
+	if h.binary {
+		if _, err := br.ReadByte(); err != nil {
+			return h, err
+		}
+	}
+	return h, nil
+}
+
+// pgmToken returns the next white space separated token, skipping comments.
+// The white space ending the token is left unread.
+func pgmToken(br *bufio.Reader) (string, error) {
+	token := bytes.Buffer{}
+	for {
+		c, err := br.ReadByte()
+		if err != nil {
+			if err == io.EOF && token.Len() > 0 {
+				return token.String(), nil
+			}
+			return "", fmt.Errorf("pgm: %v", err)
+		}
+		switch {
+		case c == '#' && token.Len() == 0:
+			if _, err := br.ReadString('\n'); err != nil {
+				return "", fmt.Errorf("pgm: %v", err)
+			}
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f':
+			if token.Len() > 0 {
+				br.UnreadByte()
+				return token.String(), nil
+			}
+		default:
+			token.WriteByte(c)
+		}
+	}
+}
+
+func decodePGMConfig(r io.Reader) (image.Config, error) {
+	h, err := readPGMHeader(bufio.NewReader(r))
+	if err != nil {
+		return image.Config{}, err
+	}
+	model := color.GrayModel
+	if h.maxval > 255 {
+		model = color.Gray16Model
+	}
+	return image.Config{ColorModel: model, Width: h.width, Height: h.height}, nil
+}
+
+// decodePGM reads binary (P5) and plain (P2) gray maps. Pixels are scaled
+// from [0, maxval] to the full range of an 8-bit, or above 255 a 16-bit, image.
+// The image is allocated once all its pixels are read, so that a truncated
+// file does not allocate the size its header claims.
+func decodePGM(r io.Reader) (image.Image, error) {
+	br := bufio.NewReader(r)
+	h, err := readPGMHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	bounds := image.Rect(0, 0, h.width, h.height)
+	n := h.width * h.height
+
+	next := func() (int, error) {
+		if !h.binary {
+			token, err := pgmToken(br)
+			if err != nil {
+				return 0, err
+			}
+			return strconv.Atoi(token)
+		}
+		hi, err := br.ReadByte()
+		if err != nil || h.maxval <= 255 {
+			return int(hi), err
+		}
+		lo, err := br.ReadByte()
+		return int(hi)<<8 | int(lo), err
+	}
+
+	pixels := []uint16{}
+	for i := 0; i < n; i++ {
+		v, err := next()
+		if err != nil {
+			return nil, fmt.Errorf("pgm: pixel %d: %v", i, err)
+		}
+		if v > h.maxval {
+			return nil, fmt.Errorf("pgm: pixel %d is %d, above maxval %d", i, v, h.maxval)
+		}
+		pixels = append(pixels, uint16(v))
+	}
+
+	if h.maxval <= 255 {
+		img := image.NewGray(bounds)
+		for i, v := range pixels {
+			img.Pix[i] = uint8(int(v) * 255 / h.maxval)
+		}
+		return img, nil
+	}
+	img := image.NewGray16(bounds)
+	for i, v := range pixels {
+		v = uint16(int(v) * 65535 / h.maxval)
+		img.Pix[2*i], img.Pix[2*i+1] = uint8(v>>8), uint8(v)
+	}
+	return img, nil
+}
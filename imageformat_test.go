@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDecodePGM(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   string
+		want   []uint8 // 8-bit pixels, or the high bytes of 16-bit ones
+		gray16 bool
+	}{
+		{"P5", "P5 3 2 255\n\x00\x10\x20\x30\x40\xff", []uint8{0x00, 0x10, 0x20, 0x30, 0x40, 0xff}, false},
+		{"P5 maxval 15", "P5\n2 2\n15\n\x00\x05\x0a\x0f", []uint8{0, 85, 170, 255}, false},
+		{"P2 with comments", "P2\n# a comment\n3 1 # another\n100\n0 50\n100", []uint8{0, 127, 255}, false},
+		{"P5 16-bit", "P5 2 1 65535\n\x12\x34\xff\xff", []uint8{0x12, 0xff}, true},
+		{"P2 16-bit", "P2 2 1 1023\n0 1023", []uint8{0, 0xff}, true},
+	}
+	for _, tt := range tests {
+		img, format, err := image.Decode(strings.NewReader(tt.data))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if format != "pgm" {
+			t.Errorf("%s: format %q, want pgm", tt.name, format)
+		}
+		var got []uint8
+		switch img := img.(type) {
+		case *image.Gray:
+			if tt.gray16 {
+				t.Errorf("%s: decoded as *image.Gray, want *image.Gray16", tt.name)
+			}
+			got = img.Pix
+		case *image.Gray16:
+			if !tt.gray16 {
+				t.Errorf("%s: decoded as *image.Gray16, want *image.Gray", tt.name)
+			}
+			for i := 0; i < len(img.Pix); i += 2 {
+				got = append(got, img.Pix[i])
+			}
+		default:
+			t.Errorf("%s: decoded as %T", tt.name, img)
+			continue
+		}
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: pixels %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDecodePGMInvalid(t *testing.T) {
+	tests := []struct {
+		name, data, err string
+	}{
+		{"truncated P5", "P5 3 2 255\n\x00\x10", "pixel 2"},
+		{"truncated P2", "P2 2 2 255\n1 2 3", "pixel 3"},
+		{"above maxval", "P2 2 1 10\n5 11", "above maxval"},
+		{"maxval too large", "P5 1 1 65536\n\x00", "maxval"},
+		{"zero width", "P5 0 1 255\n", "invalid header value"},
+		{"huge header", "P5 200000 200000 255\n\x00\x00", "too large"},
+		{"overflowing header", "P5 4611686018427387904 4 255\n\x00", "too large"},
+	}
+	for _, tt := range tests {
+		_, _, err := image.Decode(strings.NewReader(tt.data))
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: error %v, want one with %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+// writeRaw writes a raw frame and, unless sidecar is empty, its sidecar.
+func writeRaw(t *testing.T, dir string, pixels []byte, sidecar string) string {
+	t.Helper()
+	path := filepath.Join(dir, "frame.raw")
+	if err := os.WriteFile(path, pixels, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if sidecar != "" {
+		if err := os.WriteFile(rawSidecarPath(path), []byte(sidecar), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path
+}
+
+func readImageFile(path string) (image.Image, string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, "", err
+	}
+	defer file.Close()
+	return readImage(file, path)
+}
+
+func TestReadRawImage(t *testing.T) {
+	pixels := []byte{1, 2, 3, 4, 5, 6}
+	path := writeRaw(t, t.TempDir(), pixels, "# scanner frame\nwidth=3\nheight=2 # rows\n")
+	img, format, err := readImageFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format != "raw" {
+		t.Errorf("format %q, want raw", format)
+	}
+	gray, ok := img.(*image.Gray)
+	if !ok {
+		t.Fatalf("decoded as %T, want *image.Gray", img)
+	}
+	if gray.Rect != image.Rect(0, 0, 3, 2) || !bytes.Equal(gray.Pix, pixels) {
+		t.Errorf("got %v %v, want %v %v", gray.Rect, gray.Pix, image.Rect(0, 0, 3, 2), pixels)
+	}
+
+	// a frame whose first pixels look like a PGM header is still read raw
+	pixels = []byte("P5 1 1 255\n")
+	path = writeRaw(t, t.TempDir(), pixels, "width=11 height=1")
+	if img, format, err = readImageFile(path); err != nil || format != "raw" {
+		t.Errorf("frame starting with P5: format %q, error %v, want raw", format, err)
+	}
+}
+
+func TestReadRawImageInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		pixels  []byte
+		sidecar string
+		err     string
+	}{
+		{"no sidecar", []byte{1, 2, 3}, "", "no .hdr sidecar"},
+		{"missing height", []byte{1, 2, 3}, "width=3", "expected width=W height=H"},
+		{"unknown setting", []byte{1, 2, 3}, "width=3 height=1 depth=8", "unknown setting"},
+		{"not a pair", []byte{1, 2, 3}, "width 3 height 1", "expected key=value"},
+		{"not a number", []byte{1, 2, 3}, "width=three height=1", "invalid width"},
+		{"zero height", []byte{1, 2, 3}, "width=3 height=0", "invalid height"},
+		{"huge size", []byte{1, 2}, "width=200000 height=200000", "too large"},
+		{"short frame", []byte{1, 2, 3}, "width=2 height=2", "raw frame of 3 bytes"},
+		{"long frame", []byte{1, 2, 3, 4, 5}, "width=2 height=2", "raw frame of 5 bytes"},
+	}
+	for _, tt := range tests {
+		path := writeRaw(t, t.TempDir(), tt.pixels, tt.sidecar)
+		_, _, err := readImageFile(path)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: error %v, want one with %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestIsRawSidecar(t *testing.T) {
+	for name, want := range map[string]bool{
+		"64__M_Right_index_finger.hdr": true,
+		"frame.HDR":                    true,
+		"frame.raw":                    false,
+		"hdr":                          false,
+	} {
+		if got := isRawSidecar(name); got != want {
+			t.Errorf("isRawSidecar(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+)
+
+var defaultIndex = "auto"
+
+// A SearchIndex finds the templates of a model closest to a probe.
+// Every implementation returns exactly the same neighbours: ordered by
+// distance, ties broken by template index.
+type SearchIndex interface {
+	Search(feature []float64, k int) []Neighbour
+}
+
+type indexFactory func(templates []Template, distance DistanceFunc, metric bool) (SearchIndex, error)
+
+var indexes = map[string]indexFactory{
+	"bruteforce": NewBruteForceIndex,
+	"vptree":     NewVPTreeIndex,
+}
+
+func IndexNames() []string {
+	names := []string{"auto"}
+	for name := range indexes {
+		names = append(names, name)
+	}
+	sort.Strings(names[1:])
+	return names
+}
+
+// NewSearchIndex builds the named index over the templates. `auto` picks the
+// vantage point tree when the distance allows it, the brute force otherwise.
+func NewSearchIndex(name string, templates []Template, distanceName string) (SearchIndex, error) {
+	distance, err := DistanceByName(distanceName)
+	if err != nil {
+		return nil, err
+	}
+	metric := metricDistances[distanceName]
+	if name == "auto" {
+		name = "bruteforce"
+		if metric {
+			name = "vptree"
+		}
+	}
+	factory, ok := indexes[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown index %q (available: %s)", name, strings.Join(IndexNames(), ", "))
+	}
+	index, err := factory(templates, distance, metric)
+	if err != nil {
+		return nil, fmt.Errorf("index %s: %v", name, err)
+	}
+	return index, nil
+}
+
+// A Candidate is a subject of the gallery ranked for a probe, scored by its
+// closest template.
+type Candidate struct {
+	SubjectID string
+	Score     float64
+	Source    string
+}
+
+// TopCandidates returns the n subjects of the model closest to the probe,
+// best first, scored on the scale of the model. Subjects own several
+// templates, so the search widens until it has seen n distinct subjects or
+// the whole gallery.
+func TopCandidates(index SearchIndex, model *Model, feature []float64, n int) []Candidate {
+	templates := model.Templates
+	for k := n; ; k *= 2 {
+		if k > len(templates) {
+			k = len(templates)
+		}
+		candidates := []Candidate{}
+		seen := map[string]bool{}
+		for _, neighbour := range index.Search(feature, k) {
+			t := templates[neighbour.Index]
+			if seen[t.SubjectID] {
+				continue
+			}
+			seen[t.SubjectID] = true
+			candidates = append(candidates, Candidate{
+				SubjectID: t.SubjectID,
+				Score:     model.Similarity(neighbour.Distance),
+				Source:    t.Source,
+			})
+			if len(candidates) == n {
+				break
+			}
+		}
+		if len(candidates) == n || k == len(templates) {
+			return candidates
+		}
+	}
+}
+
+// neighbourList keeps the k best neighbours seen so far, sorted.
+type neighbourList struct {
+	k          int
+	neighbours []Neighbour
+}
+
+func newNeighbourList(k int) *neighbourList {
+	return &neighbourList{k: k, neighbours: make([]Neighbour, 0, k+1)}
+}
+
+func closer(a, b Neighbour) bool {
+	if a.Distance != b.Distance {
+		return a.Distance < b.Distance
+	}
+	return a.Index < b.Index
+}
+
+func (l *neighbourList) push(index int, distance float64) {
+	n := Neighbour{Index: index, Distance: distance}
+	if len(l.neighbours) == l.k && !closer(n, l.neighbours[l.k-1]) {
+		return
+	}
+	pos := sort.Search(len(l.neighbours), func(i int) bool { return closer(n, l.neighbours[i]) })
+	l.neighbours = append(l.neighbours, Neighbour{})
+	copy(l.neighbours[pos+1:], l.neighbours[pos:])
+	l.neighbours[pos] = n
+	if len(l.neighbours) > l.k {
+		l.neighbours = l.neighbours[:l.k]
+	}
+}
+
+// bound is the distance a template must beat to enter the list.
+func (l *neighbourList) bound() float64 {
+	if len(l.neighbours) < l.k {
+		return math.Inf(1)
+	}
+	return l.neighbours[l.k-1].Distance
+}
+
+// bruteForceIndex compares the probe with every template, O(n). It is the
+// reference the other indexes are checked against.
+type bruteForceIndex struct {
+	templates []Template
+	distance  DistanceFunc
+}
+
+func NewBruteForceIndex(templates []Template, distance DistanceFunc, metric bool) (SearchIndex, error) {
+	return &bruteForceIndex{templates: templates, distance: distance}, nil
+}
+
+func (b *bruteForceIndex) Search(feature []float64, k int) []Neighbour {
+	nearest := newNeighbourList(k)
+	for i, t := range b.templates {
+		nearest.push(i, b.distance(t.Feature, feature))
+	}
+	return nearest.neighbours
+}
+
+// vpTreeIndex is a vantage point tree: every node splits the templates below
+// it into those within radius of its own template and those beyond. The
+// triangle inequality lets the search skip the side which cannot hold a
+// closer template, O(log n) on average.
+type vpTreeIndex struct {
+	templates []Template
+	distance  DistanceFunc
+	root      *vpNode
+}
+
+type vpNode struct {
+	index   int
+	radius  float64
+	inside  *vpNode
+	outside *vpNode
+}
+
+// relative slack absorbing rounding errors, so that pruning never drops a
+// template the brute force would have returned.
+const vpSlack = 1e-9
+
+func NewVPTreeIndex(templates []Template, distance DistanceFunc, metric bool) (SearchIndex, error) {
+	if !metric {
+		return nil, fmt.Errorf("the distance is not a metric, use the bruteforce index")
+	}
+	t := &vpTreeIndex{templates: templates, distance: distance}
+	items := make([]int, len(templates))
+	for i := range items {
+		items[i] = i
+	}
+	// a fixed seed keeps the tree, hence the search cost, reproducible.
+	t.root = t.build(items, make([]float64, len(templates)), rand.New(rand.NewSource(1)))
+	return t, nil
+}
+
+func (t *vpTreeIndex) build(items []int, dist []float64, rnd *rand.Rand) *vpNode {
+	if len(items) == 0 {
+		return nil
+	}
+	pick := rnd.Intn(len(items))
+	items[0], items[pick] = items[pick], items[0]
+	node := &vpNode{index: items[0]}
+	rest, dist := items[1:], dist[1:len(items)]
+	if len(rest) == 0 {
+		return node
+	}
+
+	vp := t.templates[node.index].Feature
+	for i, item := range rest {
+		dist[i] = t.distance(vp, t.templates[item].Feature)
+	}
+	sort.Sort(byDistance{rest, dist})
+
+	median := len(rest) / 2
+	node.radius = dist[median]
+	node.inside = t.build(rest[:median], dist[:median], rnd)
+	node.outside = t.build(rest[median:], dist[median:], rnd)
+	return node
+}
+
+func (t *vpTreeIndex) Search(feature []float64, k int) []Neighbour {
+	nearest := newNeighbourList(k)
+	t.search(t.root, feature, nearest)
+	return nearest.neighbours
+}
+
+func (t *vpTreeIndex) search(node *vpNode, feature []float64, nearest *neighbourList) {
+	if node == nil {
+		return
+	}
+	d := t.distance(t.templates[node.index].Feature, feature)
+	nearest.push(node.index, d)
+
+	// visit the side the probe falls in first, it tightens the bound sooner.
+	if d < node.radius {
+		if d-t.reach(nearest, d, node.radius) <= node.radius {
+			t.search(node.inside, feature, nearest)
+		}
+		if d+t.reach(nearest, d, node.radius) >= node.radius {
+			t.search(node.outside, feature, nearest)
+		}
+	} else {
+		if d+t.reach(nearest, d, node.radius) >= node.radius {
+			t.search(node.outside, feature, nearest)
+		}
+		if d-t.reach(nearest, d, node.radius) <= node.radius {
+			t.search(node.inside, feature, nearest)
+		}
+	}
+}
+
+// reach is the current bound, widened by the rounding error of the distances
+// involved in the comparison.
+func (t *vpTreeIndex) reach(nearest *neighbourList, d, radius float64) float64 {
+	bound := nearest.bound()
+	return bound + vpSlack*(bound+d+radius)
+}
+
+// byDistance sorts the items of a node by their distance to the vantage point.
+type byDistance struct {
+	items []int
+	dist  []float64
+}
+
+func (b byDistance) Len() int { return len(b.items) }
+
+func (b byDistance) Less(i, j int) bool { return b.dist[i] < b.dist[j] }
+
+func (b byDistance) Swap(i, j int) {
+	b.items[i], b.items[j] = b.items[j], b.items[i]
+	b.dist[i], b.dist[j] = b.dist[j], b.dist[i]
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// randomTemplates returns n templates of dim small integer values, so that
+// many of them are at the same distance from a probe, and some are equal.
+func randomTemplates(rng *rand.Rand, n, dim, levels int) []Template {
+	templates := make([]Template, n)
+	for i := range templates {
+		if i > 0 && rng.Intn(10) == 0 {
+			templates[i] = templates[rng.Intn(i)]
+			continue
+		}
+		feature := make([]float64, dim)
+		for j := range feature {
+			feature[j] = float64(rng.Intn(levels))
+		}
+		templates[i] = Template{SubjectID: fmt.Sprint(rng.Intn(50)), Feature: feature}
+	}
+	return templates
+}
+
+// TestVPTreeMatchesBruteForce checks that the vantage point tree returns
+// the same neighbours as the brute force, ties included.
+func TestVPTreeMatchesBruteForce(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, distanceName := range []string{"l1", "l2"} {
+		for _, levels := range []int{3, 1000} {
+			templates := randomTemplates(rng, 500, 6, levels)
+			brute, err := NewSearchIndex("bruteforce", templates, distanceName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tree, err := NewSearchIndex("vptree", templates, distanceName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for probe := 0; probe < 100; probe++ {
+				var feature []float64
+				if probe%2 == 0 {
+					feature = templates[rng.Intn(len(templates))].Feature
+				} else {
+					feature = randomTemplates(rng, 1, 6, levels)[0].Feature
+				}
+				for k := 1; k <= 20; k++ {
+					want := brute.Search(feature, k)
+					got := tree.Search(feature, k)
+					if len(want) != k || !reflect.DeepEqual(got, want) {
+						t.Fatalf("%s, %d levels, probe %v, k=%d:\nvptree     %v\nbruteforce %v", distanceName, levels, feature, k, got, want)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestVPTreeSmallGalleries(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	for n := 0; n <= 5; n++ {
+		templates := randomTemplates(rng, n, 3, 2)
+		brute, _ := NewSearchIndex("bruteforce", templates, "l2")
+		tree, err := NewSearchIndex("vptree", templates, "l2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		feature := []float64{1, 0, 1}
+		// k beyond the gallery returns all of it
+		if got, want := tree.Search(feature, n+2), brute.Search(feature, n+2); len(got) != n || !reflect.DeepEqual(got, want) {
+			t.Errorf("%d templates: vptree %v, bruteforce %v", n, got, want)
+		}
+	}
+}
+
+func TestNewSearchIndex(t *testing.T) {
+	templates := randomTemplates(rand.New(rand.NewSource(3)), 10, 3, 4)
+	if _, err := NewSearchIndex("vptree", templates, "chi2"); err == nil {
+		t.Error("vptree accepted chi2, which is not a metric")
+	}
+	for distanceName, want := range map[string]string{"l2": "*main.vpTreeIndex", "chi2": "*main.bruteForceIndex"} {
+		index, err := NewSearchIndex("auto", templates, distanceName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprintf("%T", index); got != want {
+			t.Errorf("auto index for %s is %s, want %s", distanceName, got, want)
+		}
+	}
+}
+
+func TestTopCandidates(t *testing.T) {
+	m := &Model{Scale: 1e30}
+	for i, subject := range []string{"a", "a", "b", "c", "c"} {
+		m.Add([]float64{float64(i) * 1e30}, subject, fmt.Sprint(i))
+	}
+	index, err := NewSearchIndex("bruteforce", m.Templates, "l1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// one candidate per subject, scored by its closest template
+	want := []Candidate{{"c", 1, "4"}, {"b", 1.0 / 3, "2"}, {"a", 0.25, "1"}}
+	if got := TopCandidates(index, m, []float64{4e30}, 5); !reflect.DeepEqual(got, want) {
+		t.Errorf("candidates %v, want %v", got, want)
+	}
+	if got := TopCandidates(index, m, []float64{4e30}, 2); !reflect.DeepEqual(got, want[:2]) {
+		t.Errorf("2 candidates %v, want %v", got, want[:2])
+	}
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The kernels of the Sobel extractors are picked by name from a bank, in
+// this format: a `[name]` line, then the rows of the kernel, values separated
+// by spaces or commas. Both sizes must be odd, `#` starts a comment.
+//
+// The built-in bank holds the kernels tried so far, `-train -kernels file`
+// adds or replaces kernels from a file.
+const builtinKernels = `
+# https://www.geeksforgeeks.org/image-edge-detection-operators-in-digital-image-processing/
+
+# horizontal edges, the default
+[sobel-h5]
+ 2  2  4  2  2
+ 1  1  2  1  1
+ 0  0  0  0  0
+-1 -1 -2 -1 -1
+-2 -2 -4 -2 -2
+
+# vertical edges
+[sobel-v5]
+2 1 0 -1 -2
+2 1 0 -1 -2
+4 2 0 -2 -4
+2 1 0 -1 -2
+2 1 0 -1 -2
+
+[sobel-h3]
+ 1  2  1
+ 0  0  0
+-1 -1 -1
+
+[sobel-v3]
+1 0 -1
+2 0 -2
+1 0 -1
+
+# 100% on Alter-Medium
+# 90% on Real
+# very poor on Alter-Easy and Alter-Hard (Unseen)
+[scharr-h3]
++3 +10 +3
+ 0   0  0
+-3 -10 -3
+`
+
+var defaultKernels = "sobel-h5"
+
+var kernelBank = map[string]Kernel{}
+
+func init() {
+	if err := readKernelBank(strings.NewReader(builtinKernels), kernelBank); err != nil {
+		panic(err)
+	}
+}
+
+// LoadKernelBank adds the kernels of a file to the bank, replacing the ones
+// with the same name.
+func LoadKernelBank(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := readKernelBank(f, kernelBank); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+// readKernelBank reads the kernels of a bank into bank, it fails on a bank
+// without any kernel.
+func readKernelBank(r io.Reader, bank map[string]Kernel) error {
+	name, rows, line, read := "", [][]float64{}, 0, 0
+	flush := func() error {
+		if name == "" {
+			return nil
+		}
+		if len(rows) == 0 {
+			return fmt.Errorf("kernel %s has no values", name)
+		}
+		values := []float64{}
+		for _, row := range rows {
+			if len(row) != len(rows[0]) {
+				return fmt.Errorf("kernel %s has rows of %d and %d values", name, len(rows[0]), len(row))
+			}
+			values = append(values, row...)
+		}
+		k, err := newOddKernel(len(rows[0]), len(rows), values)
+		if err != nil {
+			return fmt.Errorf("kernel %s: %v", name, err)
+		}
+		bank[name] = k
+		read++
+		return nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line++
+		text := scanner.Text()
+		if i := strings.Index(text, "#"); i >= 0 {
+			text = text[:i]
+		}
+		text = strings.TrimSpace(text)
+		switch {
+		case text == "":
+		case strings.HasPrefix(text, "["):
+			if err := flush(); err != nil {
+				return err
+			}
+			if !strings.HasSuffix(text, "]") || !validKernelName(text[1:len(text)-1]) {
+				return fmt.Errorf("line %d: invalid kernel name %s, expected [name] of letters, digits, - and _", line, text)
+			}
+			name, rows = text[1:len(text)-1], nil
+		case name == "":
+			return fmt.Errorf("line %d: values before the first [name]", line)
+		default:
+			row := []float64{}
+			for _, field := range strings.FieldsFunc(text, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' }) {
+				v, err := strconv.ParseFloat(field, 64)
+				if err != nil {
+					return fmt.Errorf("line %d: %v", line, err)
+				}
+				if math.IsNaN(v) || math.IsInf(v, 0) {
+					return fmt.Errorf("line %d: %s is not a finite value", line, field)
+				}
+				row = append(row, v)
+			}
+			rows = append(rows, row)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	if read == 0 {
+		return fmt.Errorf("no kernel, expected a [name] line followed by its rows")
+	}
+	return nil
+}
+
+func validKernelName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+func newOddKernel(width, height int, values []float64) (Kernel, error) {
+	if width%2 == 0 || height%2 == 0 {
+		return Kernel{}, fmt.Errorf("%dx%d is not an odd size", width, height)
+	}
+	return NewKernel(width, height, values)
+}
+
+func KernelNames() []string {
+	names := []string{}
+	for name := range kernelBank {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// How the responses of several kernels are combined: the features of every
+// response one after the other, or the features of their magnitude,
+// sqrt(sum r^2), or of the largest of them.
+var kernelCombinations = []string{"concat", "magnitude", "max"}
+
+// A kernelSet is what the Sobel extractors convolve with. It is recorded in
+// the model as the `kernel` parameter, the values of every kernel, so that
+// a model does not depend on the bank it was trained with; `kernels` keeps
+// their names, `combine` how their responses are combined and `border` how
+// the image is extended, unless it is replicated as older versions did.
+type kernelSet struct {
+	names   []string
+	kernels []Kernel
+	combine string
+	border  BorderMode
+}
+
+// kernelSetParam reads the `kernels`, `kernel`, `combine` and `border`
+// parameters. Given, the values of `kernel` take precedence over the bank.
+// Models of older versions only record `kernel`, a single 5x5 kernel.
+func kernelSetParam(params map[string]string) (*kernelSet, error) {
+	s := &kernelSet{combine: params["combine"], border: BorderReplicate}
+	if name, ok := params["border"]; ok {
+		var err error
+		if s.border, err = BorderModeByName(name); err != nil {
+			return nil, fmt.Errorf("parameter border: %v", err)
+		}
+	}
+	names, hasNames := params["kernels"]
+	values, hasValues := params["kernel"]
+	if !hasNames && !hasValues {
+		names, hasNames = defaultKernels, true
+	}
+	if hasNames {
+		s.names = strings.Split(names, "+")
+	}
+	if hasValues {
+		var err error
+		if s.kernels, err = parseKernels(values); err != nil {
+			return nil, fmt.Errorf("parameter kernel: %v", err)
+		}
+		if hasNames && len(s.names) != len(s.kernels) {
+			return nil, fmt.Errorf("parameter kernels names %d kernels, kernel holds %d", len(s.names), len(s.kernels))
+		}
+	} else {
+		for _, name := range s.names {
+			k, ok := kernelBank[name]
+			if !ok {
+				return nil, fmt.Errorf("parameter kernels: unknown kernel %q (available: %s)", name, strings.Join(KernelNames(), ", "))
+			}
+			s.kernels = append(s.kernels, k)
+		}
+	}
+
+	if len(s.kernels) == 1 {
+		s.combine = ""
+	} else if s.combine == "" {
+		s.combine = kernelCombinations[0]
+	}
+	if s.combine != "" {
+		found := false
+		for _, c := range kernelCombinations {
+			found = found || c == s.combine
+		}
+		if !found {
+			return nil, fmt.Errorf("parameter combine must be one of %s, got %q", strings.Join(kernelCombinations, ", "), s.combine)
+		}
+	}
+	return s, nil
+}
+
+// addParams records the set into the parameters of an extractor.
+func (s *kernelSet) addParams(params map[string]string) map[string]string {
+	params["kernel"] = formatKernels(s.kernels)
+	if len(s.names) > 0 {
+		params["kernels"] = strings.Join(s.names, "+")
+	}
+	if s.combine != "" {
+		params["combine"] = s.combine
+	}
+	if s.border != BorderReplicate {
+		params["border"] = s.border.String()
+	}
+	return params
+}
+
+// outputs is the number of images apply returns.
+func (s *kernelSet) outputs() int {
+	if s.combine == "concat" {
+		return len(s.kernels)
+	}
+	return 1
+}
+
+// apply convolves with every kernel, combines the responses and clamps them
+// to [0, 255].
+func (s *kernelSet) apply(gray *image.Gray) []*image.Gray {
+	responses := make([]*SignedGray, len(s.kernels))
+	for i, k := range s.kernels {
+		responses[i] = ModelSobel(gray, k, s.border)
+	}
+	if s.combine == "concat" || len(responses) == 1 {
+		images := make([]*image.Gray, len(responses))
+		for i, r := range responses {
+			images[i] = r.Clamp()
+		}
+		return images
+	}
+	combined := NewSignedGray(responses[0].Rect)
+	for i := range combined.Pix {
+		switch s.combine {
+		case "magnitude":
+			var sum float64
+			for _, r := range responses {
+				sum += float64(r.Pix[i]) * float64(r.Pix[i])
+			}
+			combined.Pix[i] = float32(math.Sqrt(sum))
+		case "max":
+			max := responses[0].Pix[i]
+			for _, r := range responses[1:] {
+				if r.Pix[i] > max {
+					max = r.Pix[i]
+				}
+			}
+			combined.Pix[i] = max
+		}
+	}
+	return []*image.Gray{combined.Clamp()}
+}
+
+// formatKernels renders kernels as the `kernel` parameter: the values of a
+// square kernel, those of another one after its `WxH:` size, separated by
+// `;`. A single 5x5 kernel is written as older versions did.
+func formatKernels(kernels []Kernel) string {
+	parts := make([]string, len(kernels))
+	for i, k := range kernels {
+		parts[i] = formatKernel(k.Values)
+		if k.Width != k.Height {
+			parts[i] = fmt.Sprintf("%dx%d:%s", k.Width, k.Height, parts[i])
+		}
+	}
+	return strings.Join(parts, ";")
+}
+
+func parseKernels(s string) ([]Kernel, error) {
+	kernels := []Kernel{}
+	for _, part := range strings.Split(s, ";") {
+		width, height := 0, 0
+		if i := strings.Index(part, ":"); i >= 0 {
+			if _, err := fmt.Sscanf(part[:i], "%dx%d", &width, &height); err != nil {
+				return nil, fmt.Errorf("invalid kernel size %q, expected WxH", part[:i])
+			}
+			part = part[i+1:]
+		}
+		values := []float64{}
+		for _, field := range strings.Split(part, ",") {
+			v, err := strconv.ParseFloat(field, 64)
+			if err != nil {
+				return nil, err
+			}
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				return nil, fmt.Errorf("%s is not a finite value", field)
+			}
+			values = append(values, v)
+		}
+		if width == 0 {
+			width = int(math.Round(math.Sqrt(float64(len(values)))))
+			height = width
+		}
+		k, err := newOddKernel(width, height, values)
+		if err != nil {
+			return nil, err
+		}
+		kernels = append(kernels, k)
+	}
+	return kernels, nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadKernelBank(t *testing.T) {
+	bank := map[string]Kernel{}
+	err := readKernelBank(strings.NewReader(`
+# a comment
+[wide-h]   # trailing comment
+1, 2, 3, 2, 1
+0,0,0,0,0
+-1 -2 -3 -2 -1
+
+[dot_1]
+	2.5
+`), bank)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]Kernel{
+		"wide-h": {5, 3, []float64{1, 2, 3, 2, 1, 0, 0, 0, 0, 0, -1, -2, -3, -2, -1}},
+		"dot_1":  {1, 1, []float64{2.5}},
+	}
+	if !reflect.DeepEqual(bank, want) {
+		t.Errorf("bank %v, want %v", bank, want)
+	}
+
+	for _, name := range []string{"sobel-h5", "sobel-v5", "sobel-h3", "sobel-v3", "scharr-h3"} {
+		if _, ok := kernelBank[name]; !ok {
+			t.Errorf("built-in kernel %s missing", name)
+		}
+	}
+}
+
+func TestReadKernelBankInvalid(t *testing.T) {
+	tests := []struct {
+		name, bank, err string
+	}{
+		{"empty", "", "no kernel"},
+		{"comments only", "# nothing yet\n\n", "no kernel"},
+		{"no values", "[a]\n[b]\n1\n", "kernel a has no values"},
+		{"values first", "1 2 3\n[a]\n", "line 1: values before the first [name]"},
+		{"invalid name", "[a b]\n1\n", "line 1: invalid kernel name [a b]"},
+		{"unclosed name", "[a\n1\n", "invalid kernel name [a"},
+		{"even width", "[a]\n1 2\n", "kernel a: 2x1 is not an odd size"},
+		{"even height", "[a]\n1 2 1\n-1 -2 -1\n", "kernel a: 3x2 is not an odd size"},
+		{"ragged rows", "[a]\n1 2 1\n0 0\n-1 -2 -1\n", "kernel a has rows of 3 and 2 values"},
+		{"non numeric", "[a]\n1 2 1\n0 x 0\n-1 -2 -1\n", "line 3: strconv.ParseFloat: parsing \"x\""},
+		{"not a number", "[a]\nNaN\n", "line 2: NaN is not a finite value"},
+		{"infinite", "[a]\n1 -Inf 1\n", "line 2: -Inf is not a finite value"},
+	}
+	for _, tt := range tests {
+		err := readKernelBank(strings.NewReader(tt.bank), map[string]Kernel{})
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: error %v, want one with %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestLoadKernelBank(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bank.txt")
+	if err := os.WriteFile(path, []byte("# empty\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadKernelBank(path); err == nil || !strings.HasPrefix(err.Error(), path+": ") {
+		t.Errorf("error %v, want one naming %s", err, path)
+	}
+}
+
+func TestParseKernels(t *testing.T) {
+	kernels := []Kernel{kernelBank["sobel-h5"], {3, 1, []float64{1, 0, -1}}, {1, 1, []float64{0.25}}}
+	got, err := parseKernels(formatKernels(kernels))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, kernels) {
+		t.Errorf("kernels %v, want %v", got, kernels)
+	}
+
+	for _, value := range []string{
+		"",                  // no value
+		"1,2,3,4",           // 2x2
+		"1,2,3",             // not square, without a size
+		"2x2:1,2,3,4",       // even
+		"3x3:1,2,3",         // too few values
+		"-1x1:1",            // negative
+		"axb:1",             // not a size
+		"1,x,3,4,5,6,7,8,9", // not a number
+		"3x1:1,NaN,1",       // not finite
+		"1;",                // an empty second kernel
+	} {
+		if _, err := parseKernels(value); err == nil {
+			t.Errorf("kernel=%s accepted", value)
+		}
+	}
+}
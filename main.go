@@ -3,27 +3,32 @@ package main
 import (
 	"os"
 	"io"
+	"path/filepath"
 	"image"
 	"fmt"
 	"log"
-	"sort"
+	"math"
+	"flag"
 	"strings"
+	"strconv"
+	"sort"
 	"bufio"
 	"runtime"
 	"sync"
 	"time"
 
 	"golang.org/x/image/bmp"
-	"github.com/disintegration/imaging"
 )
 
 var (
 
 	trainDataset,  testDataset =  `../Датасет/Датасет/SOCOFing/Real/`, `../Датасет/Датасет/SOCOFing/Altered/Altered-Hard/`
 	//trainDataset,  testDataset =  ``, ``
-	model_cache_file = `./model.cache.txt`
+	model_cache_file = `./model.cache.bin`
+	legacy_model_cache_file = `./model.cache.txt`
 	model_predictions_file = `./model.predictions.txt`
 	digestLen = 25
+	digestBase = 3.0
 	nNcpu = runtime.NumCPU()
 )
 
@@ -31,260 +36,935 @@ func main() {
 
 	if len(os.Args) < 2 {
 		log.Printf("Usage: %s [-test|-train]", os.Args[0])
-		log.Printf("%s -train <directory_of_training_images>", os.Args[0])
-		log.Printf("%s -test <directory_of_images_to_test>", os.Args[0])
+		log.Printf("%s -train [-extractor name] [-param key=value] [-distance l2] [-threshold 0] [-kernels bank.txt] [-workers N] [-max-failures 0.05] <directory_of_training_images>", os.Args[0])
+		log.Printf("%s -test [-extractor name] [-param key=value] [-k 1] [-candidates 5] [-distance name] [-index auto] [-filter field=value] [-manifest labels.csv] [-workers N] [-max-failures 0.05] <directory_of_images_to_test>", os.Args[0])
+		log.Printf("%s -enroll <subjectID> <image...>", os.Args[0])
+		log.Printf("%s -delete <subjectID>", os.Args[0])
+		log.Printf("%s -verify <image> <subjectID>", os.Args[0])
+		log.Printf("%s -evaluate [-distance name] [-curve roc.csv] [-points 1000] [-filter field=value] [-manifest labels.csv] [-workers N] [-max-failures 0.05] <directory_of_labelled_images>", os.Args[0])
+		log.Printf("%s -accuracy [-by field] [-filter field=value]", os.Args[0])
+		log.Printf("%s -threshold [similarity]", os.Args[0])
+		log.Printf("%s -minutiae [-enhance] <image>", os.Args[0])
+		log.Printf("%s -mask [-param segment=variance] <image> <output.bmp>", os.Args[0])
+		log.Printf("%s -orientation [-block 8] [-smooth 1] [-scale 4] <image> <overlay.bmp>", os.Args[0])
+		log.Printf("%s -enhance [-block 8] [-sigma 4] <image> <output.bmp>", os.Args[0])
+		log.Printf("%s -skeleton [-enhance] [-overlay] <image> <output.bmp>", os.Args[0])
 		return
 	}
 
 	if os.Args[1] == "-train" {
-		if len(os.Args) > 2 {
-			trainDataset = os.Args[2]
+		flags := flag.NewFlagSet("-train", flag.ExitOnError)
+		extractorName := flags.String("extractor", defaultExtractor, "feature extractor, one of: "+strings.Join(ExtractorNames(), ", "))
+		params := paramFlags{}
+		flags.Var(params, "param", "extractor parameter as key=value, may be repeated")
+		distanceName := flags.String("distance", defaultDistance, "distance between features, one of: "+strings.Join(DistanceNames(), ", "))
+		threshold := flags.Float64("threshold", 0, "similarity a probe must reach to be accepted by -verify, 0 calibrates it on the training images")
+		filter := SampleFilter{}
+		flags.Var(filter, "filter", "only use images whose name has field=value (subject, gender, hand, finger, alteration), may be repeated")
+		workers := flags.Int("workers", nNcpu, "number of images processed in parallel")
+		maxFailures := flags.Float64("max-failures", defaultMaxFailureRate, "exit with an error when more than this share of the images cannot be read")
+		kernelFile := flags.String("kernels", "", "file of named kernels, for the kernels parameter of the Sobel extractors")
+		flags.Parse(os.Args[2:])
+		if *workers < 1 {
+			log.Fatalf("-workers must be at least 1, got %d", *workers)
+		}
+		if flags.NArg() > 0 {
+			trainDataset = flags.Arg(0)
+		}
+		if *kernelFile != "" {
+			if err := LoadKernelBank(*kernelFile); err != nil {
+				log.Fatal(err)
+			}
+		}
+		extractor, err := NewExtractor(*extractorName, params)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if _, err := DistanceByName(*distanceName); err != nil {
+			log.Fatal(err)
 		}
 		files, err := os.ReadDir(trainDataset);
 		if err != nil {
-			panic(err)
+			log.Fatal(err)
 		}
 		fileList := []string{}
 		for _, file := range files {
-			fileList = append(fileList, file.Name())
+			if isRawSidecar(file.Name()) {
+				continue
+			}
+			info, err := ParseSampleName(file.Name())
+			if err != nil {
+				log.Printf("[!] Skipping %v\n", err)
+				continue
+			}
+			if filter.Match(info) {
+				fileList = append(fileList, file.Name())
+			}
+		}
+		if err := Train(fileList, NewModel(extractor, *distanceName, *threshold), extractor, *workers, *maxFailures); err != nil {
+			log.Fatal(err)
 		}
-		Train(fileList)
 	}else if os.Args[1] == "-test" {
-		
-		/*
-		if len(os.Args) > 2 {
-			testDataset = os.Args[2]
+		flags := flag.NewFlagSet("-test", flag.ExitOnError)
+		extractorName := flags.String("extractor", "", "feature extractor, defaults to the one recorded in the model")
+		params := paramFlags{}
+		flags.Var(params, "param", "extractor parameter as key=value, may be repeated")
+		k := flags.Int("k", 1, "number of nearest neighbours voting for the subject")
+		distanceName := flags.String("distance", "", "distance between features, defaults to the one recorded in the model")
+		indexName := flags.String("index", defaultIndex, "gallery search index, one of: "+strings.Join(IndexNames(), ", "))
+		candidates := flags.Int("candidates", 5, "length of the ranked candidate list written with each prediction")
+		filter := SampleFilter{}
+		flags.Var(filter, "filter", "only test images whose label has field=value (subject, gender, hand, finger, alteration), may be repeated")
+		manifest := flags.String("manifest", "", "CSV file of file,label rows, for images which are not named after their subject")
+		workers := flags.Int("workers", nNcpu, "number of images processed in parallel")
+		maxFailures := flags.Float64("max-failures", defaultMaxFailureRate, "exit with an error when more than this share of the images cannot be read")
+		flags.Parse(os.Args[2:])
+		if *workers < 1 {
+			log.Fatalf("-workers must be at least 1, got %d", *workers)
+		}
+		if *k < 1 {
+			log.Fatalf("-k must be at least 1, got %d", *k)
+		}
+		if *candidates < 1 {
+			log.Fatalf("-candidates must be at least 1, got %d", *candidates)
+		}
+		if flags.NArg() > 0 {
+			testDataset = flags.Arg(0)
 		}
-		files, err := os.ReadDir(testDataset);
+		images, err := LoadLabelledImages(testDataset, *manifest, filter)
 		if err != nil {
-			panic(err)
+			log.Fatal(err)
 		}
-
-
-		fileList := []string{}
-		for _, file := range files {
-			fileList = append(fileList, file.Name())
+		if err := Test(images, *extractorName, params, *k, *candidates, *distanceName, *indexName, *workers, *maxFailures); err != nil {
+			log.Fatal(err)
 		}
-
-
-		Test(fileList)*/
-		Test()
+	}else if os.Args[1] == "-enroll" {
+		if len(os.Args) < 4 {
+			log.Fatalf("Usage: %s -enroll <subjectID> <image...>", os.Args[0])
+		}
+		if err := Enroll(os.Args[2], os.Args[3:]); err != nil {
+			log.Fatal(err)
+		}
+	}else if os.Args[1] == "-delete" {
+		if len(os.Args) < 3 {
+			log.Fatalf("Usage: %s -delete <subjectID>", os.Args[0])
+		}
+		if err := Delete(os.Args[2]); err != nil {
+			log.Fatal(err)
+		}
+	}else if os.Args[1] == "-verify" {
+		if len(os.Args) < 4 {
+			log.Fatalf("Usage: %s -verify <image> <subjectID>", os.Args[0])
+		}
+		accepted, err := Verify(os.Args[2], os.Args[3])
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !accepted {
+			os.Exit(1)
+		}
+	}else if os.Args[1] == "-evaluate" {
+		flags := flag.NewFlagSet("-evaluate", flag.ExitOnError)
+		distanceName := flags.String("distance", "", "distance between features, defaults to the one recorded in the model")
+		curveFile := flags.String("curve", "", "write the FAR/FRR curve to this CSV file")
+		points := flags.Int("points", 1000, "maximum number of rows of the CSV curve")
+		filter := SampleFilter{}
+		flags.Var(filter, "filter", "only use images whose name has field=value (subject, gender, hand, finger, alteration), may be repeated")
+		manifest := flags.String("manifest", "", "CSV file of file,label rows, for images which are not named after their subject")
+		workers := flags.Int("workers", nNcpu, "number of images processed in parallel")
+		maxFailures := flags.Float64("max-failures", defaultMaxFailureRate, "exit with an error when more than this share of the images cannot be read")
+		flags.Parse(os.Args[2:])
+		if *workers < 1 {
+			log.Fatalf("-workers must be at least 1, got %d", *workers)
+		}
+		if *points < 2 {
+			log.Fatalf("-points must be at least 2, got %d", *points)
+		}
+		if flags.NArg() < 1 {
+			log.Fatalf("Usage: %s -evaluate [-distance name] [-curve roc.csv] [-points 1000] [-filter field=value] [-manifest labels.csv] [-workers N] [-max-failures 0.05] <directory_of_labelled_images>", os.Args[0])
+		}
+		images, err := LoadLabelledImages(flags.Arg(0), *manifest, filter)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := Evaluate(images, *distanceName, *curveFile, *points, *workers, *maxFailures); err != nil {
+			log.Fatal(err)
+		}
+	}else if os.Args[1] == "-accuracy" {
+		flags := flag.NewFlagSet("-accuracy", flag.ExitOnError)
+		by := flags.String("by", "", "break the accuracy down by one of: "+strings.Join(sampleFields, ", "))
+		filter := SampleFilter{}
+		flags.Var(filter, "filter", "only count predictions whose label has field=value, may be repeated")
+		flags.Parse(os.Args[2:])
+		if *by != "" {
+			if _, err := (SampleInfo{}).Field(*by); err != nil {
+				log.Fatal(err)
+			}
+		}
+		breakdown, err := AccuracyBy(*by, filter)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, value := range sortedKeys(breakdown) {
+			c := breakdown[value]
+			if value == "" {
+				value = "all"
+			}
+			log.Printf("%s Pass := %d/%d (%.2f%%)\n", value, c.pass, c.total, 100*float64(c.pass)/float64(c.total))
+		}
+	}else if os.Args[1] == "-threshold" {
+		model, err := loadModelCache()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(os.Args) < 3 {
+			fmt.Printf("%g\n", model.Threshold)
+			return
+		}
+		threshold, err := strconv.ParseFloat(os.Args[2], 64)
+		if err != nil {
+			log.Fatal(err)
+		}
+		model.Threshold = threshold
+		if err := saveModelCache(model); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("[+] Verification threshold set to %g in %s\n", threshold, model_cache_file)
+	}else if os.Args[1] == "-minutiae" {
+		flags := flag.NewFlagSet("-minutiae", flag.ExitOnError)
+		enhance := flags.Bool("enhance", false, "enhance the ridges with Gabor filters first")
+		flags.Parse(os.Args[2:])
+		if flags.NArg() < 1 {
+			log.Fatalf("Usage: %s -minutiae [-enhance] <image>", os.Args[0])
+		}
+		img, err := loadImageFile(flags.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *enhance {
+			grayImg, err := toGrayScale(img)
+			if err != nil {
+				log.Fatal(err)
+			}
+			img = GaborEnhance(grayImg, defaultGaborBlock, defaultGaborSigma)
+		}
+		minutiae, err := ExtractMinutiae(img)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, m := range minutiae {
+			fmt.Printf("%d %d %.1f %s %.2f\n", m.X, m.Y, m.Angle*180/math.Pi, m.Type, m.Quality)
+		}
+		log.Printf("[+] %d minutiae found\n", len(minutiae))
+	}else if os.Args[1] == "-convert" {
+		flags := flag.NewFlagSet("-convert", flag.ExitOnError)
+		flags.Float64Var(&wsqBitrate, "bitrate", wsqBitrate, "WSQ bit rate in bits per pixel, 0.75 is about 15:1")
+		flags.Parse(os.Args[2:])
+		if flags.NArg() < 2 {
+			log.Fatalf("Usage: %s -convert [-bitrate 0.75] <image> <output.bmp|output.wsq>", os.Args[0])
+		}
+		img, err := loadImageFile(flags.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := saveImageFile(flags.Arg(1), img); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("[+] %s written\n", flags.Arg(1))
+	}else if os.Args[1] == "-mask" {
+		flags := flag.NewFlagSet("-mask", flag.ExitOnError)
+		params := paramFlags{"segment": "variance"}
+		flags.Var(params, "param", "segmentation parameter as key=value (segment, segmentBlock, segmentThreshold), may be repeated")
+		flags.Parse(os.Args[2:])
+		if flags.NArg() < 2 {
+			log.Fatalf("Usage: %s -mask [-param segment=variance] [-param segmentBlock=8] [-param segmentThreshold=0.3] <image> <output.bmp>", os.Args[0])
+		}
+		for k := range params {
+			if k != "segment" && k != "segmentBlock" && k != "segmentThreshold" {
+				log.Fatalf("-mask has no parameter %q", k)
+			}
+		}
+		segment, err := segmentParam(params)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if segment.method == "none" {
+			log.Fatalf("-mask needs a segment method")
+		}
+		img, err := loadImageFile(flags.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+		grayImg, err := toGrayScale(img)
+		if err != nil {
+			log.Fatal(err)
+		}
+		mask := segment.apply(grayImg)
+		if err := saveImageFile(flags.Arg(1), mask); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("[+] %s written, %d of %d pixels on the print\n", flags.Arg(1), len(maskedPixels(mask, mask)), len(mask.Pix))
+	}else if os.Args[1] == "-orientation" {
+		flags := flag.NewFlagSet("-orientation", flag.ExitOnError)
+		block := flags.Int("block", defaultOrientationBlock, "block size in pixels")
+		smooth := flags.Float64("smooth", defaultOrientationSmooth, "Gaussian smoothing of the field in blocks, 0 for none")
+		scale := flags.Int("scale", 4, "enlargement of the overlay")
+		flags.Parse(os.Args[2:])
+		if flags.NArg() < 2 {
+			log.Fatalf("Usage: %s -orientation [-block 8] [-smooth 1] [-scale 4] <image> <overlay.bmp>", os.Args[0])
+		}
+		if *block < 2 || *scale < 1 || *smooth < 0 {
+			log.Fatalf("-block must be at least 2, -scale at least 1 and -smooth not negative")
+		}
+		img, err := loadImageFile(flags.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+		grayImg, err := toGrayScale(img)
+		if err != nil {
+			log.Fatal(err)
+		}
+		field := EstimateOrientation(grayImg, *block, *smooth)
+		if err := saveImageFile(flags.Arg(1), field.Overlay(grayImg, *scale)); err != nil {
+			log.Fatal(err)
+		}
+		var coherence float64
+		for _, c := range field.Coherence {
+			coherence += c
+		}
+		log.Printf("[+] %s written, %dx%d blocks, mean coherence %.2f\n", flags.Arg(1), field.Width, field.Height, coherence/float64(len(field.Coherence)))
+	}else if os.Args[1] == "-enhance" {
+		flags := flag.NewFlagSet("-enhance", flag.ExitOnError)
+		block := flags.Int("block", defaultGaborBlock, "block size of the orientation and frequency estimation in pixels")
+		sigma := flags.Float64("sigma", defaultGaborSigma, "Gaussian envelope of the Gabor kernels in pixels")
+		flags.Parse(os.Args[2:])
+		if flags.NArg() < 2 {
+			log.Fatalf("Usage: %s -enhance [-block 8] [-sigma 4] <image> <output.bmp>", os.Args[0])
+		}
+		params := map[string]string{"preprocess": "gabor", "gaborBlock": strconv.Itoa(*block), "gaborSigma": strconv.FormatFloat(*sigma, 'g', -1, 64)}
+		preprocess, err := preprocessParam(params)
+		if err != nil {
+			log.Fatal(err)
+		}
+		img, err := loadImageFile(flags.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+		grayImg, err := toGrayScale(img)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := saveImageFile(flags.Arg(1), preprocess.apply(grayImg)); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("[+] %s written\n", flags.Arg(1))
+	}else if os.Args[1] == "-skeleton" {
+		flags := flag.NewFlagSet("-skeleton", flag.ExitOnError)
+		enhance := flags.Bool("enhance", false, "enhance the ridges with Gabor filters first")
+		overlay := flags.Bool("overlay", false, "draw the skeleton in red over the image")
+		flags.Parse(os.Args[2:])
+		if flags.NArg() < 2 {
+			log.Fatalf("Usage: %s -skeleton [-enhance] [-overlay] <image> <output.bmp>", os.Args[0])
+		}
+		img, err := loadImageFile(flags.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+		grayImg, err := toGrayScale(img)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *enhance {
+			grayImg = GaborEnhance(grayImg, defaultGaborBlock, defaultGaborSigma)
+		}
+		skeleton, stats := Skeleton(grayImg)
+		var out image.Image = skeleton
+		if *overlay {
+			out = SkeletonOverlay(grayImg, skeleton)
+		}
+		if err := saveImageFile(flags.Arg(1), out); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("[+] %s written, %d holes filled, %d spurs and %d bridges removed\n", flags.Arg(1), stats.Holes, stats.Spurs, stats.Bridges)
 	}
 }
 
 
 // 1. INPUT : All the image files in direcotry
-// 2. OUTPUT : A text file `model.cache.txt` which contains all the generated digests for the images
-// 3. Candidate for concurrency at every file iteration.
-func Train(fileList []string) {
-
-	digestsCache := []float64{}
-	digestToSubjectID := make(map[float64]string) // map digest to Subject id
-
-	log.Println("[!] Starting Training")
-	for _, fileName := range fileList {
-		// 1. load io.Reader for image file from filesystem
-		filepath := fmt.Sprintf(`%s/%s`, trainDataset, fileName)
-		img, err := loadImageFile(filepath)
-		if err != nil {
-			panic(err)
-		}
-		
+// 2. OUTPUT : A binary file `model.cache.bin` which contains all the generated features for the images
+// 3. The images are processed by a pool of workers, each feature lands at
+// the index of its file so the model does not depend on the scheduling.
+// Unreadable images are left out of the model and reported, the model is not
+// saved when more than maxFailureRate of them failed. The distance scale, and
+// the threshold unless one is given, are calibrated on the images, see
+// Model.Calibrate.
+func Train(fileList []string, model *Model, extractor FeatureExtractor, workers int, maxFailureRate float64) error {
+
+	log.Printf("[!] Starting Training with extractor %s [%s] and %d workers\n", extractor.Name(), formatParams(extractor.Params()), workers)
+	features := make([][]float64, len(fileList))
+	errs := make([]error, len(fileList))
+	jobs := make(chan int, workers)
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				// 1. load io.Reader for image file from filesystem
+				filepath := fmt.Sprintf(`%s/%s`, trainDataset, fileList[j])
+				img, err := loadImageFile(filepath)
+				if err != nil {
+					errs[j] = err
+					continue
+				}
 
-		// 2. Convert normal image into GrayScale image.
-		grayImg, err := toGrayScale(img); 
-		if err != nil {
-			panic(err)
+				// 2. Compute the features of the image
+				if features[j], err = extractor.Extract(img); err != nil {
+					errs[j] = fmt.Errorf("%s: %v", filepath, err)
+				}
+			}
+		}()
+	}
+	for j := range fileList {
+		jobs <- j
+	}
+	close(jobs)
+	wg.Wait()
+
+	report := &FailureReport{Total: len(fileList)}
+	for j, fileName := range fileList {
+		if errs[j] != nil {
+			report.Add(fileName, errs[j])
+			continue
 		}
-	
-		// 3. Apply `Sobel Operator` Horizontal kernel on image matrix
-		sobelImg := ModelSobel(grayImg)
-		sobelImgGray, err := toGrayScale(sobelImg)
+		info, err := ParseSampleName(fileName)
 		if err != nil {
-			panic(err)
+			report.Add(fileName, err)
+			continue
 		}
-		
-		top_pixel_values, top_frequencies := PixelFrequencyDistribution(sobelImgGray.Pix)
-		
-		digest := digestFrequencyDistribution(top_pixel_values, top_frequencies)
-		digestsCache = append(digestsCache, digest)
-		subjectEntry := strings.Split(fileName, "_")
-		digestToSubjectID[digest] = subjectEntry[0]
+		model.Add(features[j], info.SubjectID, fileName)
 	}
 
-	sort.SliceStable(digestsCache, func(i, j int) bool { return digestsCache[i] < digestsCache[j]})
-	
-	// save the values to a file.
-	f, err := os.Create(model_cache_file)
+	log.Println("[+] Ended Training")
+	report.Log()
+	if err := report.Check(maxFailureRate); err != nil {
+		return err
+	}
+	// an empty model would replace the one saved
+	if len(model.Templates) == 0 {
+		return fmt.Errorf("no template was computed, the model is not saved")
+	}
+	// a threshold of 0 is calibrated on the training images
+	eer, err := model.Calibrate(model.Threshold != 0)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	defer f.Close()
-
-	log.Println("[+] Ended Training")
-	log.Println("[!] Saving computed parameters to disk")
-	for _, digest := range digestsCache {
-		_, err := fmt.Fprintf(f, "%f:%s\n", digest, digestToSubjectID[digest])
-		if err != nil {
-			panic(err)
+	if eer >= 0 {
+		log.Printf("[+] Distance scale %g, threshold %g at the gallery EER of %.4f\n", model.Scale, model.Threshold, eer)
+	} else {
+		if model.Threshold == 0 {
+			log.Printf("[!] No subject has several templates to calibrate the threshold on, using %g\n", defaultThreshold)
+			model.Threshold = defaultThreshold
 		}
+		log.Printf("[+] Distance scale %g, threshold %g\n", model.Scale, model.Threshold)
+	}
+	log.Println("[!] Saving computed parameters to disk")
+	if err := saveModelCache(model); err != nil {
+		return err
 	}
 	log.Printf("[+] Parameters saved to %s\n", model_cache_file)
+	return nil
 }
 
 
-// 1. INPUT : An image
-// 2. OUTPUT: The person ID associated to that file.
-func Test() {
-
-	// test data
-
-	test_data := map[string]string{"00000.bmp": "64__M_Right_index_finger", "00001.bmp": "452__F_Left_index_finger", "00002.bmp": "351__M_Left_little_finger", "00003.bmp": "421__F_Right_index_finger", "00004.bmp": "540__F_Right_ring_finger", "00005.bmp": "410__M_Right_thumb_finger", "00006.bmp": "586__M_Left_thumb_finger", "00007.bmp": "75__F_Right_ring_finger", "00008.bmp": "177__F_Left_ring_finger", "00009.bmp": "365__M_Left_middle_finger", "00010.bmp": "312__M_Right_little_finger", "00011.bmp": "575__M_Right_index_finger", "00012.bmp": "267__M_Left_thumb_finger", "00013.bmp": "79__M_Right_middle_finger", "00014.bmp": "122__M_Left_index_finger", "00015.bmp": "218__M_Left_middle_finger", "00016.bmp": "25__F_Left_little_finger", "00017.bmp": "136__F_Right_little_finger", "00018.bmp": "115__F_Right_middle_finger", "00019.bmp": "558__M_Right_little_finger", "00020.bmp": "249__M_Left_thumb_finger", "00021.bmp": "281__M_Left_index_finger", "00022.bmp": "391__M_Right_little_finger", "00023.bmp": "211__M_Right_thumb_finger", "00024.bmp": "451__M_Right_little_finger", "00025.bmp": "453__F_Left_ring_finger", "00026.bmp": "334__F_Right_ring_finger", "00027.bmp": "149__F_Right_little_finger", "00028.bmp": "306__M_Left_little_finger", "00029.bmp": "77__M_Left_thumb_finger", "00030.bmp": "78__F_Right_middle_finger", "00031.bmp": "389__F_Right_middle_finger", "00032.bmp": "119__F_Left_thumb_finger", "00033.bmp": "468__F_Right_little_finger", "00034.bmp": "52__M_Left_little_finger", "00035.bmp": "217__M_Right_ring_finger", "00036.bmp": "294__M_Left_middle_finger", "00037.bmp": "215__M_Right_little_finger", "00038.bmp": "312__M_Left_thumb_finger", "00039.bmp": "372__M_Left_middle_finger", "00040.bmp": "276__M_Left_little_finger", "00041.bmp": "53__M_Right_thumb_finger", "00042.bmp": "378__F_Left_middle_finger", "00043.bmp": "175__M_Right_index_finger", "00044.bmp": "130__F_Left_thumb_finger", "00045.bmp": "411__M_Right_thumb_finger", "00046.bmp": "475__M_Left_index_finger", "00047.bmp": "88__F_Left_middle_finger", "00048.bmp": "142__F_Left_middle_finger", "00049.bmp": "309__M_Right_little_finger", "00050.bmp": "460__M_Left_middle_finger", "00051.bmp": "428__M_Right_little_finger", "00052.bmp": "563__M_Right_index_finger", "00053.bmp": "476__M_Left_middle_finger", "00054.bmp": "59__F_Right_thumb_finger", "00055.bmp": "125__M_Right_middle_finger", "00056.bmp": "396__M_Left_little_finger", "00057.bmp": "219__M_Left_index_finger", "00058.bmp": "413__M_Left_middle_finger", "00059.bmp": "179__M_Left_little_finger", "00060.bmp": "110__F_Left_thumb_finger", "00061.bmp": "333__M_Left_index_finger", "00062.bmp": "311__M_Right_index_finger", "00063.bmp": "290__M_Left_thumb_finger", "00064.bmp": "330__M_Right_middle_finger", "00065.bmp": "442__F_Right_ring_finger", "00066.bmp": "446__M_Right_index_finger", "00067.bmp": "278__M_Right_little_finger", "00068.bmp": "233__M_Right_ring_finger", "00069.bmp": "205__F_Left_thumb_finger", "00070.bmp": "431__M_Left_little_finger", "00071.bmp": "581__F_Right_middle_finger", "00072.bmp": "300__F_Right_index_finger", "00073.bmp": "354__M_Left_middle_finger", "00074.bmp": "426__M_Left_ring_finger", "00075.bmp": "481__F_Left_thumb_finger", "00076.bmp": "172__M_Right_little_finger", "00077.bmp": "407__M_Left_index_finger", "00078.bmp": "481__F_Left_little_finger", "00079.bmp": "468__F_Right_middle_finger", "00080.bmp": "518__M_Right_thumb_finger", "00081.bmp": "274__M_Right_ring_finger", "00082.bmp": "263__F_Right_thumb_finger", "00083.bmp": "120__M_Right_index_finger", "00084.bmp": "481__F_Right_little_finger", "00085.bmp": "391__M_Right_index_finger", "00086.bmp": "518__M_Right_middle_finger", "00087.bmp": "129__M_Left_little_finger", "00088.bmp": "318__F_Left_index_finger", "00089.bmp": "577__M_Left_middle_finger", "00090.bmp": "212__M_Left_ring_finger", "00091.bmp": "304__M_Left_index_finger", "00092.bmp": "158__M_Right_little_finger", "00093.bmp": "361__M_Left_middle_finger", "00094.bmp": "239__M_Right_little_finger", "00095.bmp": "487__M_Left_middle_finger", "00096.bmp": "294__M_Right_little_finger", "00097.bmp": "30__F_Left_index_finger", "00098.bmp": "560__F_Right_little_finger", "00099.bmp": "93__M_Left_ring_finger", "00100.bmp": "182__M_Left_little_finger", "00101.bmp": "587__M_Left_ring_finger", "00102.bmp": "518__M_Left_index_finger", "00103.bmp": "235__M_Right_middle_finger", "00104.bmp": "391__M_Left_ring_finger", "00105.bmp": "504__M_Left_thumb_finger", "00106.bmp": "600__M_Right_index_finger", "00107.bmp": "114__F_Right_ring_finger", "00108.bmp": "477__M_Right_thumb_finger", "00109.bmp": "525__M_Left_middle_finger", "00110.bmp": "154__F_Right_little_finger", "00111.bmp": "117__F_Right_little_finger", "00112.bmp": "97__M_Left_ring_finger", "00113.bmp": "221__M_Right_little_finger", "00114.bmp": "174__F_Left_ring_finger", "00115.bmp": "106__M_Left_middle_finger", "00116.bmp": "466__F_Left_ring_finger", "00117.bmp": "147__M_Left_ring_finger", "00118.bmp": "273__M_Left_middle_finger", "00119.bmp": "465__F_Left_middle_finger", "00120.bmp": "165__M_Left_ring_finger", "00121.bmp": "35__M_Left_thumb_finger", "00122.bmp": "494__F_Left_ring_finger", "00123.bmp": "472__M_Left_ring_finger", "00124.bmp": "105__M_Right_middle_finger", "00125.bmp": "456__M_Right_middle_finger", "00126.bmp": "70__M_Right_middle_finger", "00127.bmp": "399__M_Right_ring_finger", "00128.bmp": "270__M_Right_thumb_finger", "00129.bmp": "196__M_Right_little_finger", "00130.bmp": "110__F_Right_thumb_finger", "00131.bmp": "126__F_Right_index_finger", "00132.bmp": "500__M_Right_middle_finger", "00133.bmp": "171__M_Left_little_finger", "00134.bmp": "55__M_Left_ring_finger", "00135.bmp": "407__M_Left_little_finger", "00136.bmp": "533__M_Left_thumb_finger", "00137.bmp": "562__F_Left_thumb_finger", "00138.bmp": "238__M_Left_ring_finger", "00139.bmp": "245__M_Left_ring_finger", "00140.bmp": "284__M_Left_thumb_finger", "00141.bmp": "261__M_Right_middle_finger", "00142.bmp": "217__M_Right_thumb_finger", "00143.bmp": "64__M_Left_thumb_finger", "00144.bmp": "362__M_Left_little_finger", "00145.bmp": "121__F_Left_little_finger", "00146.bmp": "435__F_Left_thumb_finger", "00147.bmp": "416__M_Right_middle_finger", "00148.bmp": "308__M_Right_middle_finger", "00149.bmp": "225__M_Left_little_finger", "00150.bmp": "347__M_Left_thumb_finger", "00151.bmp": "313__M_Left_index_finger", "00152.bmp": "396__M_Left_ring_finger", "00153.bmp": "52__M_Right_middle_finger", "00154.bmp": "514__F_Right_little_finger", "00155.bmp": "254__M_Left_ring_finger", "00156.bmp": "354__M_Right_thumb_finger", "00157.bmp": "519__M_Left_middle_finger", "00158.bmp": "132__M_Left_index_finger", "00159.bmp": "524__M_Right_little_finger", "00160.bmp": "191__F_Right_middle_finger", "00161.bmp": "352__M_Left_ring_finger", "00162.bmp": "368__M_Left_middle_finger", "00163.bmp": "264__M_Right_thumb_finger", "00164.bmp": "73__M_Right_ring_finger", "00165.bmp": "221__M_Left_ring_finger", "00166.bmp": "104__M_Left_index_finger", "00167.bmp": "367__M_Right_ring_finger", "00168.bmp": "229__M_Right_index_finger", "00169.bmp": "374__M_Right_middle_finger", "00170.bmp": "23__M_Right_index_finger", "00171.bmp": "342__M_Left_ring_finger", "00172.bmp": "597__M_Right_middle_finger", "00173.bmp": "401__M_Right_little_finger", "00174.bmp": "321__M_Right_thumb_finger", "00175.bmp": "266__M_Left_index_finger", "00176.bmp": "594__M_Right_thumb_finger", "00177.bmp": "286__M_Right_little_finger", "00178.bmp": "139__M_Right_middle_finger", "00179.bmp": "479__F_Left_thumb_finger", "00180.bmp": "66__F_Left_index_finger", "00181.bmp": "15__F_Left_index_finger", "00182.bmp": "503__M_Left_little_finger", "00183.bmp": "30__F_Left_little_finger", "00184.bmp": "469__M_Left_little_finger", "00185.bmp": "534__F_Left_ring_finger", "00186.bmp": "314__M_Left_little_finger", "00187.bmp": "519__M_Right_index_finger", "00188.bmp": "250__F_Left_middle_finger", "00189.bmp": "13__F_Left_thumb_finger", "00190.bmp": "203__M_Left_index_finger", "00191.bmp": "13__F_Right_index_finger", "00192.bmp": "122__M_Left_ring_finger", "00193.bmp": "493__M_Right_thumb_finger", "00194.bmp": "409__M_Right_little_finger", "00195.bmp": "86__M_Right_little_finger", "00196.bmp": "521__M_Right_index_finger", "00197.bmp": "165__M_Right_middle_finger", "00198.bmp": "447__M_Left_middle_finger", "00199.bmp": "366__M_Left_middle_finger", "00200.bmp": "180__F_Right_ring_finger", "00201.bmp": "112__M_Left_middle_finger", "00202.bmp": "50__M_Left_little_finger", "00203.bmp": "451__M_Right_index_finger", "00204.bmp": "77__M_Right_ring_finger", "00205.bmp": "36__M_Right_middle_finger", "00206.bmp": "374__M_Left_thumb_finger", "00207.bmp": "554__M_Left_little_finger", "00208.bmp": "252__F_Right_middle_finger", "00209.bmp": "379__F_Right_little_finger", "00210.bmp": "421__F_Left_thumb_finger", "00211.bmp": "235__M_Left_little_finger", "00212.bmp": "467__M_Right_middle_finger", "00213.bmp": "141__F_Right_ring_finger", "00214.bmp": "7__M_Left_little_finger", "00215.bmp": "197__M_Right_ring_finger", "00216.bmp": "583__M_Left_index_finger", "00217.bmp": "408__M_Left_little_finger", "00218.bmp": "167__M_Left_little_finger", "00219.bmp": "84__M_Left_thumb_finger", "00220.bmp": "597__M_Left_ring_finger", "00221.bmp": "341__M_Left_index_finger", "00222.bmp": "390__F_Right_thumb_finger", "00223.bmp": "37__M_Right_middle_finger", "00224.bmp": "40__F_Left_index_finger", "00225.bmp": "163__M_Left_thumb_finger", "00226.bmp": "394__M_Left_index_finger", "00227.bmp": "54__M_Right_index_finger", "00228.bmp": "202__M_Left_thumb_finger", "00229.bmp": "517__M_Right_thumb_finger", "00230.bmp": "421__F_Left_little_finger", "00231.bmp": "496__M_Left_thumb_finger", "00232.bmp": "174__F_Right_little_finger", "00233.bmp": "139__M_Right_thumb_finger", "00234.bmp": "253__F_Right_index_finger", "00235.bmp": "90__M_Left_index_finger", "00236.bmp": "46__M_Left_index_finger", "00237.bmp": "122__M_Left_thumb_finger", "00238.bmp": "313__M_Left_middle_finger", "00239.bmp": "173__F_Right_thumb_finger", "00240.bmp": "325__M_Right_index_finger", "00241.bmp": "89__M_Right_middle_finger", "00242.bmp": "90__M_Right_middle_finger", "00243.bmp": "337__F_Right_ring_finger", "00244.bmp": "374__M_Right_index_finger", "00245.bmp": "504__M_Right_index_finger", "00246.bmp": "300__F_Right_little_finger", "00247.bmp": "596__M_Left_ring_finger", "00248.bmp": "336__M_Right_little_finger", "00249.bmp": "47__F_Right_thumb_finger", "00250.bmp": "456__M_Left_middle_finger", "00251.bmp": "114__F_Left_ring_finger", "00252.bmp": "258__M_Right_middle_finger", "00253.bmp": "564__M_Left_thumb_finger", "00254.bmp": "445__M_Left_thumb_finger", "00255.bmp": "359__M_Left_index_finger", "00256.bmp": "196__M_Right_middle_finger", "00257.bmp": "209__F_Right_index_finger", "00258.bmp": "228__M_Left_little_finger", "00259.bmp": "265__M_Left_ring_finger", "00260.bmp": "444__M_Right_little_finger", "00261.bmp": "462__M_Left_little_finger", "00262.bmp": "167__M_Right_ring_finger", "00263.bmp": "315__F_Left_middle_finger", "00264.bmp": "427__M_Left_index_finger", "00265.bmp": "98__M_Left_little_finger", "00266.bmp": "593__M_Right_ring_finger", "00267.bmp": "571__F_Left_thumb_finger", "00268.bmp": "504__M_Right_ring_finger", "00269.bmp": "206__M_Left_ring_finger", "00270.bmp": "382__M_Right_thumb_finger", "00271.bmp": "108__M_Left_ring_finger", "00272.bmp": "474__M_Right_thumb_finger", "00273.bmp": "250__F_Right_index_finger", "00274.bmp": "570__M_Left_little_finger", "00275.bmp": "211__M_Right_ring_finger", "00276.bmp": "62__M_Right_middle_finger", "00277.bmp": "420__M_Right_middle_finger", "00278.bmp": "151__M_Right_index_finger", "00279.bmp": "421__F_Right_middle_finger", "00280.bmp": "403__M_Right_little_finger", "00281.bmp": "130__F_Left_little_finger", "00282.bmp": "585__M_Right_ring_finger", "00283.bmp": "127__F_Left_index_finger", "00284.bmp": "507__M_Left_middle_finger", "00285.bmp": "480__M_Left_little_finger", "00286.bmp": "106__M_Right_middle_finger", "00287.bmp": "377__M_Right_little_finger", "00288.bmp": "586__M_Right_little_finger", "00289.bmp": "45__M_Left_index_finger", "00290.bmp": "484__M_Left_ring_finger", "00291.bmp": "261__M_Right_little_finger", "00292.bmp": "514__F_Left_ring_finger", "00293.bmp": "22__M_Right_little_finger", "00294.bmp": "507__M_Right_thumb_finger", "00295.bmp": "359__M_Right_thumb_finger", "00296.bmp": "475__M_Right_little_finger", "00297.bmp": "479__F_Left_index_finger", "00298.bmp": "72__M_Right_little_finger", "00299.bmp": "401__M_Left_middle_finger"}
+// 1. INPUT : Labelled images, see LoadLabelledImages
+// 2. OUTPUT: The person ID associated to each file, in `model.predictions.txt`.
+// The extractor recorded in the model is used unless one is given, in which
+// case it must match the model. The subject is voted by the k nearest templates,
+// and written along with the ranked list of the closest subjects, the
+// similarity of the closest template of the predicted subject and the image:
+//   predictedID:label:subjectID=score@source,subjectID=score@source,...:score:path
+// Unreadable images are skipped and reported, Test fails when more than
+// maxFailureRate of them failed.
+func Test(images []LabelledImage, extractorName string, params map[string]string, k, nCandidates int, distanceName, indexName string, workers int, maxFailureRate float64) error {
 
-	// load model.cache.txt
-	f, err := os.Open(model_cache_file)
+	// load model.cache.bin
+	model, err := loadGallery()
 	if err != nil {
-		panic(err)
+		return err
 	}
-	defer f.Close()
-
-	digestsCache := []float64{}
-	digestToSubjectID := make(map[float64]string)
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		line := scanner.Text()
-		digestStr := strings.Split(line, ":")[0]
-		subjectId := strings.Split(line, ":")[1]
-		var digest float64
-		_, err := fmt.Sscanf(digestStr, "%f", &digest)
+	extractor, err := model.NewExtractor()
+	if err != nil {
+		return err
+	}
+	if extractorName != "" {
+		chosen, err := NewExtractor(extractorName, params)
 		if err != nil {
-			panic(err)
+			return err
+		}
+		if err := model.Check(chosen); err != nil {
+			return err
 		}
-		digestsCache = append(digestsCache, digest)
-		digestToSubjectID[digest] = subjectId
+	}
+	if distanceName == "" {
+		distanceName = model.Distance
+	}
+	if distanceName != model.Distance {
+		log.Printf("[!] The model is calibrated for %s distances, the %s scores are not on its scale\n", model.Distance, distanceName)
+	}
+	index, err := NewSearchIndex(indexName, model.Templates, distanceName)
+	if err != nil {
+		return err
 	}
 
+	// before starting the workers, which nothing would drain on failure
+	fp, err := os.Create(model_predictions_file)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	w := bufio.NewWriter(fp)
 
-
-	log.Printf("Begining Testing with %d cores\n", nNcpu)
+	log.Printf("Begining Testing with %d workers\n", workers)
 	startTime := time.Now()
 
+	// every job carries its image and label, every result its job, so that
+	// labels and predictions cannot be mixed up whatever the scheduling.
+	type testJob struct {
+		index int
+		image LabelledImage
+	}
+	jobs := make(chan testJob, workers)
+	results := make(chan TestResult, workers)
 	wg := sync.WaitGroup{}
-	fileNamesChannel := make(chan string, nNcpu)
-	realSubjectIdChannel := make(chan string, nNcpu)
-	resultsChannel := make(chan string, nNcpu)
-	for i:=0; i<nNcpu; i++ {
-
+	for i := 0; i < workers; i++ {
 		wg.Add(1)
-
-		go func(){
+		go func() {
 			defer wg.Done()
-
-			for fileName := range fileNamesChannel {
-
+			for job := range jobs {
 				// 1. load io.Reader for image file from filesystem
-				filepath := fmt.Sprintf(`%s`, fileName)
-				img, err := loadImageFile(filepath)
+				result := TestResult{
+					Index: job.index,
+					Path:  job.image.Path,
+					Truth: job.image.Label,
+				}
+				img, err := loadImageFile(job.image.Path)
 				if err != nil {
-					panic(err)
+					result.Err = err
+					results <- result
+					continue
 				}
-				
 
-				// 2. Convert normal image into GrayScale image.
-				grayImg, err := toGrayScale(img); 
+				// 2. Compute the features of the image
+				feature, err := extractor.Extract(img)
 				if err != nil {
-					panic(err)
+					result.Err = fmt.Errorf("%s: %v", job.image.Path, err)
+					results <- result
+					continue
 				}
-			
-				// 3. Apply `Sobel Operator` Horizontal kernel on image matrix
-				sobelImg := ModelSobel(grayImg)
-				sobelImgGray, err := toGrayScale(sobelImg)
-				if err != nil {
-					panic(err)
+
+				// 3. Vote among the nearest templates
+				neighbours := index.Search(feature, k)
+				result.Prediction = Vote(model.Templates, neighbours)
+				for _, n := range neighbours {
+					if model.Templates[n.Index].SubjectID == result.Prediction {
+						result.Score = model.Similarity(n.Distance)
+						break
+					}
 				}
-				
-				top_pixel_values, top_frequencies := PixelFrequencyDistribution(sobelImgGray.Pix)
-				
-				digest := digestFrequencyDistribution(top_pixel_values, top_frequencies)
-
-				index, _ := Search(digestsCache, digest)
-				
-				var predictedSubjectId string
-				predictedSubjectId = digestToSubjectID[digestsCache[index]]
-				resultsChannel <- fmt.Sprintf("%s:%s", predictedSubjectId, <-realSubjectIdChannel)
+
+				// 4. Rank the closest subjects for triage
+				result.Candidates = TopCandidates(index, model, feature, nCandidates)
+				results <- result
 			}
 		}()
 	}
-
-
-	fp, _ := os.Create(model_predictions_file)
-
-	// testing the list
-	/*
-	for _, fileName := range fileList {
-		fileNamesChannel <- fileName
-		fmt.Fprintln(fp, <- resultsChannel)
-	}*/
-
-	for image,  label := range test_data {
-		fileNamesChannel <- fmt.Sprintf("./test/images/%s", image)
-		realSubjectIdChannel <- label
-		fmt.Fprintln(fp, <- resultsChannel)
+	go func() {
+		for i, image := range images {
+			jobs <- testJob{index: i, image: image}
+		}
+		close(jobs)
+		wg.Wait()
+		close(results)
+	}()
+
+	// results arrive in any order, they are written in the order of the images
+	report := &FailureReport{Total: len(images)}
+	pending := map[int]TestResult{}
+	next := 0
+	for result := range results {
+		pending[result.Index] = result
+		for r, ok := pending[next]; ok; r, ok = pending[next] {
+			if r.Err != nil {
+				report.Add(r.Path, r.Err)
+			} else {
+				fmt.Fprintf(w, "%s:%s:%s:%.6g:%s\n", r.Prediction, r.Truth, formatCandidates(r.Candidates), r.Score, r.Path)
+			}
+			delete(pending, next)
+			next++
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := fp.Close(); err != nil {
+		return err
 	}
 
 	log.Println("Tests ended")
 	log.Println("Duration := ", time.Now().Sub(startTime))
+	report.Log()
 
 
 	log.Println("Accuray:")
-	pass, total := Accuracy()
+	pass, total, err := Accuracy()
+	if err != nil {
+		return err
+	}
 	log.Printf("Total samples = %d, Pass := %d/%d,  Failed := %d/%d\n", total, pass, total, total-pass, total)
-	
+	return report.Check(maxFailureRate)
+}
 
+// A TestResult is the outcome of testing one image: its label, the subject
+// voted for, and Score, the similarity of the closest template of that
+// subject among the voters.
+type TestResult struct {
+	Index      int // position of the image in the tested list
+	Path       string
+	Truth      string
+	Prediction string
+	Score      float64
+	Candidates []Candidate
+	Err        error // the image could not be read
 }
 
-// O(n)
-func Search(digestsCache []float64, digest float64) (int, int) {
-	if digest > digestsCache[len(digestsCache)-1] {
-		return len(digestsCache)-1, int(digest - digestsCache[len(digestsCache)-1])
+// 1. INPUT : A subject and images of its fingers
+// 2. OUTPUT: The model with the templates of those images added.
+// Nothing is written unless every image could be processed, and the model is
+// replaced atomically.
+func Enroll(subjectID string, imagePaths []string) error {
+	model, err := loadModelCache()
+	if err != nil {
+		return err
 	}
-	if digest < digestsCache[0] {
-		return 0, int(digestsCache[0] - digest)
+	extractor, err := model.NewExtractor()
+	if err != nil {
+		return err
 	}
-	for i, v := range digestsCache{
-		if v == digest {
-			return i, int(v)-int(digest)
+
+	for _, imagePath := range imagePaths {
+		img, err := loadImageFile(imagePath)
+		if err != nil {
+			return err
+		}
+		feature, err := extractor.Extract(img)
+		if err != nil {
+			return err
+		}
+		replaced, err := model.Enroll(feature, subjectID, filepath.Base(imagePath))
+		if err != nil {
+			return err
+		}
+		if replaced {
+			log.Printf("[!] Replaced template %s of subject %s\n", filepath.Base(imagePath), subjectID)
+		}
+	}
+
+	if err := saveModelCache(model); err != nil {
+		return err
+	}
+	log.Printf("[+] Enrolled %d images of subject %s in %s\n", len(imagePaths), subjectID, model_cache_file)
+	return nil
+}
+
+// 1. INPUT : A subject
+// 2. OUTPUT: The model without any template of that subject.
+// The model is replaced atomically, then read back from disk to check that
+// the subject is really gone.
+func Delete(subjectID string) error {
+	model, err := loadModelCache()
+	if err != nil {
+		return err
+	}
+	removed := model.Remove(subjectID)
+	if removed == 0 {
+		return fmt.Errorf("subject %s is not enrolled in %s", subjectID, model_cache_file)
+	}
+	if err := saveModelCache(model); err != nil {
+		return err
+	}
+
+	// prove the erasure on what is actually stored
+	saved, err := LoadModel(model_cache_file)
+	if err != nil {
+		return err
+	}
+	if left := len(saved.SubjectTemplates(subjectID)); left != 0 {
+		return fmt.Errorf("subject %s still has %d templates in %s", subjectID, left, model_cache_file)
+	}
+	log.Printf("[+] Deleted subject %s: %d templates removed from %s, %d templates left, none of them from %s\n",
+		subjectID, removed, model_cache_file, len(saved.Templates), subjectID)
+	return nil
+}
+
+// 1. INPUT : An image and the subject it claims to be
+// 2. OUTPUT: Whether the image matches the templates of that subject.
+// The score is the similarity of the closest template, accepted when it
+// reaches the threshold recorded in the model.
+func Verify(filepath, subjectID string) (bool, error) {
+	model, err := loadGallery()
+	if err != nil {
+		return false, err
+	}
+	extractor, err := model.NewExtractor()
+	if err != nil {
+		return false, err
+	}
+	distance, err := DistanceByName(model.Distance)
+	if err != nil {
+		return false, err
+	}
+	templates := model.SubjectTemplates(subjectID)
+	if len(templates) == 0 {
+		return false, fmt.Errorf("subject %s is not enrolled in %s", subjectID, model_cache_file)
+	}
+
+	img, err := loadImageFile(filepath)
+	if err != nil {
+		return false, err
+	}
+	feature, err := extractor.Extract(img)
+	if err != nil {
+		return false, err
+	}
+
+	score, source := 0.0, ""
+	for _, t := range templates {
+		if s := model.Similarity(distance(t.Feature, feature)); s > score {
+			score, source = s, t.Source
 		}
-		if v > digest {
-			if i>0 && (digest - digestsCache[i-1]) < (v-digest) {
-				return i-1, int(digest)-int(digestsCache[i-1])
+	}
+
+	accepted := score >= model.Threshold
+	decision := "REJECT"
+	if accepted {
+		decision = "ACCEPT"
+	}
+	fmt.Printf("%s subject=%s score=%.6g threshold=%g template=%s\n", decision, subjectID, score, model.Threshold, source)
+	return accepted, nil
+}
+
+// 1. INPUT : Labelled images
+// 2. OUTPUT: The verification error rates of the model on those images.
+// Every probe is scored against every enrolled subject, with the best
+// similarity among the subject's templates: its own subject gives a genuine
+// score, the others impostor scores. Unreadable images are skipped and
+// reported.
+func Evaluate(images []LabelledImage, distanceName, curveFile string, points, workers int, maxFailureRate float64) error {
+	model, err := loadGallery()
+	if err != nil {
+		return err
+	}
+	extractor, err := model.NewExtractor()
+	if err != nil {
+		return err
+	}
+	if distanceName == "" {
+		distanceName = model.Distance
+	}
+	distance, err := DistanceByName(distanceName)
+	if err != nil {
+		return err
+	}
+	if distanceName != model.Distance {
+		log.Printf("[!] The model is calibrated for %s distances, the %s scores are not comparable with its threshold\n", model.Distance, distanceName)
+	}
+	subjects := []string{}
+	subjectIndex := map[string]int{}
+	for _, t := range model.Templates {
+		if _, ok := subjectIndex[t.SubjectID]; !ok {
+			subjectIndex[t.SubjectID] = len(subjects)
+			subjects = append(subjects, t.SubjectID)
+		}
+	}
+
+	log.Printf("[!] Evaluating %d images against %d subjects with %d workers\n", len(images), len(subjects), workers)
+	startTime := time.Now()
+
+	type scores struct {
+		path     string
+		err      error
+		genuine  []float64
+		impostor []float64
+	}
+	jobs := make(chan LabelledImage, workers)
+	results := make(chan scores, workers)
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			best := make([]float64, len(subjects))
+			for image := range jobs {
+				img, err := loadImageFile(image.Path)
+				if err != nil {
+					results <- scores{path: image.Path, err: err}
+					continue
+				}
+				feature, err := extractor.Extract(img)
+				if err != nil {
+					results <- scores{path: image.Path, err: fmt.Errorf("%s: %v", image.Path, err)}
+					continue
+				}
+				for i := range best {
+					best[i] = 0
+				}
+				for _, t := range model.Templates {
+					s := subjectIndex[t.SubjectID]
+					if score := model.Similarity(distance(t.Feature, feature)); score > best[s] {
+						best[s] = score
+					}
+				}
+				result := scores{}
+				for s, score := range best {
+					if subjects[s] == image.Info.SubjectID {
+						result.genuine = append(result.genuine, score)
+					} else {
+						result.impostor = append(result.impostor, score)
+					}
+				}
+				results <- result
 			}
-			return i, int(v)-int(digest)
+		}()
+	}
+	go func() {
+		for _, image := range images {
+			jobs <- image
+		}
+		close(jobs)
+		wg.Wait()
+		close(results)
+	}()
+
+	evaluation := &Evaluation{}
+	report := &FailureReport{Total: len(images)}
+	for result := range results {
+		if result.err != nil {
+			report.Add(result.path, result.err)
+			continue
+		}
+		evaluation.Genuine = append(evaluation.Genuine, result.genuine...)
+		evaluation.Impostor = append(evaluation.Impostor, result.impostor...)
+	}
+	log.Println("Duration := ", time.Now().Sub(startTime))
+	report.Log()
+	if err := report.Check(maxFailureRate); err != nil {
+		return err
+	}
+	if len(evaluation.Genuine) == 0 || len(evaluation.Impostor) == 0 {
+		return fmt.Errorf("need both genuine and impostor comparisons, got %d and %d", len(evaluation.Genuine), len(evaluation.Impostor))
+	}
+
+	curve := evaluation.Curve()
+	eer, eerThreshold := EER(curve)
+	fmr100 := FNMRAt(curve, 0.01)
+	fmr1000 := FNMRAt(curve, 0.001)
+	current := evaluation.RatesAt(model.Threshold)
+	log.Printf("Genuine comparisons := %d, Impostor comparisons := %d\n", len(evaluation.Genuine), len(evaluation.Impostor))
+	log.Printf("EER := %.4f at threshold %g\n", eer, eerThreshold)
+	log.Printf("FMR100 := %.4f at threshold %g\n", fmr100.FRR, fmr100.Threshold)
+	log.Printf("FMR1000 := %.4f at threshold %g\n", fmr1000.FRR, fmr1000.Threshold)
+	log.Printf("Model threshold %g := FAR %.4f, FRR %.4f\n", model.Threshold, current.FAR, current.FRR)
+
+	if curveFile != "" {
+		if err := WriteCurveCSV(curveFile, curve, points); err != nil {
+			return err
 		}
+		log.Printf("[+] Curve saved to %s\n", curveFile)
+	}
+	return nil
+}
+
+func formatCandidates(candidates []Candidate) string {
+	entries := []string{}
+	for _, c := range candidates {
+		entries = append(entries, fmt.Sprintf("%s=%.6g@%s", c.SubjectID, c.Score, c.Source))
 	}
-	panic("unreachable")
+	return strings.Join(entries, ",")
 }
 
-func Accuracy() (pass int, total int) {
+func Accuracy() (pass int, total int, err error) {
+	breakdown, err := AccuracyBy("", nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	all := breakdown[""]
+	if all == nil {
+		return 0, 0, nil
+	}
+	return all.pass, all.total, nil
+}
+
+type accuracyCount struct {
+	pass, total int
+}
+
+// AccuracyBy counts the rank-1 hits of `model.predictions.txt` for every value
+// of a field of the labels, e.g. every finger. An empty field counts them all
+// under "".
+func AccuracyBy(field string, filter SampleFilter) (map[string]*accuracyCount, error) {
 
 	f, err := os.Open(model_predictions_file)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+	defer f.Close()
 
+	breakdown := map[string]*accuracyCount{}
 	scanner := bufio.NewScanner(f)
 	for scanner.Scan() {
 		line := scanner.Text()
-		predictedSubjectId := strings.Split(line, ":")[0]
-		fileName := strings.Split(line, ":")[1]
-		subjectId := strings.Split(fileName, "_")[0]
+		fields := strings.Split(line, ":")
+		if len(fields) < 2 {
+			log.Printf("[!] Skipping invalid prediction %q\n", line)
+			continue
+		}
+		predictedSubjectId, fileName := fields[0], fields[1]
+		info, err := ParseSampleName(fileName)
+		if err != nil {
+			log.Printf("[!] Skipping %v\n", err)
+			continue
+		}
+		if !filter.Match(info) {
+			continue
+		}
 
-		if subjectId == predictedSubjectId {
-			pass += 1
+		key := ""
+		if field != "" {
+			key, _ = info.Field(field)
 		}
-		total += 1
+		if breakdown[key] == nil {
+			breakdown[key] = &accuracyCount{}
+		}
+		if info.SubjectID == predictedSubjectId {
+			breakdown[key].pass += 1
+		}
+		breakdown[key].total += 1
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
 	}
-	return 
+	return breakdown, nil
+}
+
+// sortedKeys lists the values of a breakdown in a stable order.
+func sortedKeys(breakdown map[string]*accuracyCount) []string {
+	keys := []string{}
+	for k := range breakdown {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
 }
 
 func loadImageFile(filepath string) (image.Image, error) {
@@ -294,9 +974,10 @@ func loadImageFile(filepath string) (image.Image, error) {
 	}
 	defer file.Close()
 
-	img, err := readBMPImage(file)
+	// BMP, PNG, JPEG, TIFF, PGM, WSQ or a raw frame, see imageformat.go
+	img, _, err := readImage(file, filepath)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("%s: %v", filepath, err)
 	}
 
 	return img, nil
@@ -311,77 +992,64 @@ func readBMPImage(r io.Reader) (image.Image, error) {
 }
 
 // https://riptutorial.com/go/example/31693/convert-color-image-to-grayscale
+//
+// The usual image types are converted without going through color.Color for
+// every pixel, see grayscale.go; the result is the same as color.GrayModel.
 func toGrayScale(img image.Image) (*image.Gray, error) {
+	switch img := img.(type) {
+	case *image.Gray:
+		return grayFromGray(img), nil
+	case *image.RGBA:
+		return grayFromRGBA(img), nil
+	case *image.NRGBA:
+		return grayFromNRGBA(img), nil
+	case *image.Paletted:
+		return grayFromPaletted(img), nil
+	}
+	return toGrayScaleGeneric(img), nil
+}
+
+// toGrayScaleGeneric converts any image, pixel by pixel.
+func toGrayScaleGeneric(img image.Image) *image.Gray {
 	grayImg := image.NewGray(img.Bounds())
 	for row := img.Bounds().Min.Y; row < img.Bounds().Max.Y; row ++ {
 		for col := img.Bounds().Min.X; col < img.Bounds().Max.X; col++ {
 			grayImg.Set(col, row, img.At(col, row))
 		}
 	}
-	return grayImg, nil
+	return grayImg
 }
 
+// saveImageFile writes a BMP, or a WSQ compressed to wsqBitrate when the
+// path ends with .wsq.
 func saveImageFile(filepath string, img image.Image) (error) {
 	f, err := os.Create(filepath)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
+	if strings.HasSuffix(strings.ToLower(filepath), ".wsq") {
+		if err := encodeWSQ(f, img, wsqBitrate); err != nil {
+			return err
+		}
+		return f.Close()
+	}
 	if err := bmp.Encode(f, img); err != nil {
 		return err
 	}
 	return nil
 }
 
-//https://www.geeksforgeeks.org/image-edge-detection-operators-in-digital-image-processing/
-func ModelSobel(img image.Image) (*image.NRGBA){
-
-	/*
-	kernel := [9]float64{
-		1, 2, 1,
-		0, 0, 0,
-		-1, -1, -1,
-	}
-	*/
-
-	/*
-	// 100% on Alter-Medium
-	// 90% on Real
-	// very poor on Alter-Easy and Alter-Hard (Unseen)
-	kernel := [9]float64 {
-		+3, +10, +3,
-		0, 0, 0,
-		-3, -10, -3,
-	}*/
-
-	kernel := [25]float64 {
-	 	2, 2, 4, 2, 2,
-	 	1, 1, 2, 1, 1,
-	 	0, 0, 0, 0, 0,
-	 	-1, -1, -2, -1, -1,
-	 	-2, -2, -4, -2, -2,
-	 }
-
-	/*
-	kernel := [25]float64 {
-		2, 1, 0, -1, -2,
-		2, 1, 0, -1, -2,
-		4, 2, 0, -2, -4,
-		2, 1, 0, -1, -2,
-		2, 1, 0, -1, -2,
-	}*/
-
-	/*
-	kernel := [9]float64{
-		1, 0, -1,
-		2, 0, -2,
-		1, 0, -1,
-	} */
-
-	imgConvo := imaging.Convolve5x5(
+// ModelSobel convolves with one kernel of the bank, see kernels.go, the image
+// extended by border. It keeps the signed response, the Sobel extractors
+// clamp it to [0, 255] as imaging.Convolve5x5 did, so their features do not
+// change.
+func ModelSobel(img *image.Gray, kernel Kernel, border BorderMode) (*SignedGray){
+
+	imgConvo := Convolve(
 		img,
 		kernel,
-		nil,
+		border,
 	)
 
 	return imgConvo
@@ -392,7 +1060,7 @@ func ModelSobel(img image.Image) (*image.NRGBA){
 // Ratios between their frequencies are likely going to be the same accross
 // images showing the same fingeprint.
 // kind of identification based on frequency of pixels
-func PixelFrequencyDistribution(pixels []uint8) ([]uint, []uint){
+func PixelFrequencyDistribution(pixels []uint8, digestLen int) ([]uint, []uint){
 	var arr  [256]uint // pixel values range from 0-255
 	var top_pixel_values []uint // the top most common pixel values execept '0'
 	var top_frequencies []uint // the frequencies of the top
@@ -427,12 +1095,13 @@ func findMaxElement(arr [256]uint) (uint, uint) {
 }
 
 // just a simple attempt to combine the frequencies of all the top5 elements
-// into a searchable unique integer.
-func digestFrequencyDistribution(top_pixel_values, top_frequencies []uint) float64 {
+// into a searchable unique integer. base is the `digestBase` parameter of the
+// sobel-histogram extractor, 3 by default.
+func digestFrequencyDistribution(top_pixel_values, top_frequencies []uint, base float64) float64 {
 	var digest float64 = 1
 	for i:=0; i<len(top_frequencies); i++ {
 		//digest = digest*padding(top_frequencies[i]) + top_frequencies[i]
-		digest =  digest * (3 + float64(top_pixel_values[i])/float64(top_frequencies[i]))
+		digest =  digest * (base + float64(top_pixel_values[i])/float64(top_frequencies[i]))
 	}
 	return digest
 }
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"image"
+	"math"
+)
+
+var (
+	minutiaeBorder   = 8 // pixels ignored along the image border
+	minutiaeTraceLen = 8 // pixels followed along a ridge to estimate the angle
+	minutiaeMinDist  = 5 // minutiae closer than this are treated as noise
+	minutiaeWindow   = 6 // radius of the block used to measure local contrast
+)
+
+type MinutiaType int
+
+const (
+	RidgeEnding MinutiaType = iota
+	RidgeBifurcation
+)
+
+func (t MinutiaType) String() string {
+	if t == RidgeBifurcation {
+		return "bifurcation"
+	}
+	return "ending"
+}
+
+// A Minutia is a ridge ending or a bifurcation found on the ridge skeleton.
+// Angle is in radians, measured in image coordinates (y grows downwards),
+// and points along the ridge towards the minutia. Quality is in [0, 1].
+type Minutia struct {
+	X, Y    int
+	Angle   float64
+	Type    MinutiaType
+	Quality float64
+}
+
+// neighbours of a pixel, clockwise starting from north.
+var (
+	nbDx = [8]int{0, 1, 1, 1, 0, -1, -1, -1}
+	nbDy = [8]int{-1, -1, 0, 1, 1, 1, 0, -1}
+)
+
+// 1. INPUT : An image
+// 2. OUTPUT : The ridge endings and bifurcations found on its skeleton.
+// Skeleton -> crossing number -> false minutiae removal
+// Only the minutiae at least minutiaeBorder pixels inside the print, as the
+// variance segmentation finds it, are kept: the ridges end where the print
+// does, and the noise of the background makes ridges of its own.
+func ExtractMinutiae(img image.Image) ([]Minutia, error) {
+	grayImg, err := toGrayScale(img)
+	if err != nil {
+		return nil, err
+	}
+	mask := SegmentFingerprint(grayImg, "variance", defaultSegmentBlock, defaultSegmentThresholds["variance"])
+	skeleton, _ := Skeleton(grayImg)
+	minutiae := detectMinutiae(skeleton, grayImg, erodeMask(mask, minutiaeBorder))
+	return removeFalseMinutiae(minutiae), nil
+}
+
+// thin reduces the black ridges of a binary image to one pixel wide lines
+// using the Zhang-Suen algorithm.
+func thin(bin *image.Gray) *image.Gray {
+	w, h := bin.Bounds().Dx(), bin.Bounds().Dy()
+	grid := make([]uint8, w*h) // 1 = ridge
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if bin.Pix[y*bin.Stride+x] == 0 {
+				grid[y*w+x] = 1
+			}
+		}
+	}
+
+	var p [8]uint8
+	deleted := []int{}
+	for changed := true; changed; {
+		changed = false
+		for step := 0; step < 2; step++ {
+			deleted = deleted[:0]
+			for y := 1; y < h-1; y++ {
+				for x := 1; x < w-1; x++ {
+					if grid[y*w+x] == 0 {
+						continue
+					}
+					var b, a int
+					for k := 0; k < 8; k++ {
+						p[k] = grid[(y+nbDy[k])*w+x+nbDx[k]]
+						b += int(p[k])
+					}
+					if b < 2 || b > 6 {
+						continue
+					}
+					for k := 0; k < 8; k++ {
+						if p[k] == 0 && p[(k+1)%8] == 1 {
+							a++
+						}
+					}
+					if a != 1 {
+						continue
+					}
+					// p[0]=N p[2]=E p[4]=S p[6]=W
+					if step == 0 && (p[0]*p[2]*p[4] != 0 || p[2]*p[4]*p[6] != 0) {
+						continue
+					}
+					if step == 1 && (p[0]*p[2]*p[6] != 0 || p[0]*p[4]*p[6] != 0) {
+						continue
+					}
+					deleted = append(deleted, y*w+x)
+				}
+			}
+			for _, i := range deleted {
+				grid[i] = 0
+			}
+			if len(deleted) > 0 {
+				changed = true
+			}
+		}
+	}
+
+	skeleton := image.NewGray(bin.Bounds())
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if grid[y*w+x] == 1 {
+				skeleton.Pix[y*skeleton.Stride+x] = 0
+			} else {
+				skeleton.Pix[y*skeleton.Stride+x] = 255
+			}
+		}
+	}
+	return skeleton
+}
+
+func isRidge(img *image.Gray, x, y int) bool {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	if x < 0 || y < 0 || x >= w || y >= h {
+		return false
+	}
+	return img.Pix[y*img.Stride+x] == 0
+}
+
+// crossingNumber is half the number of ridge/valley transitions around a pixel:
+// 1 on a ridge ending, 2 inside a ridge, 3 on a bifurcation.
+func crossingNumber(skeleton *image.Gray, x, y int) int {
+	var cn int
+	for k := 0; k < 8; k++ {
+		a := isRidge(skeleton, x+nbDx[k], y+nbDy[k])
+		b := isRidge(skeleton, x+nbDx[(k+1)%8], y+nbDy[(k+1)%8])
+		if a != b {
+			cn++
+		}
+	}
+	return cn / 2
+}
+
+// branchStarts returns one neighbour per ridge leaving (x, y). Neighbours
+// touching each other belong to the same ridge, the 4-connected one is kept.
+func branchStarts(skeleton *image.Gray, x, y int) []image.Point {
+	k0 := -1
+	for k := 0; k < 8; k++ {
+		if !isRidge(skeleton, x+nbDx[k], y+nbDy[k]) {
+			k0 = k
+			break
+		}
+	}
+	if k0 < 0 {
+		return nil
+	}
+
+	starts := []image.Point{}
+	inRun, runHasCross := false, false
+	for i := 1; i <= 8; i++ {
+		k := (k0 + i) % 8
+		p := image.Pt(x+nbDx[k], y+nbDy[k])
+		if !isRidge(skeleton, p.X, p.Y) {
+			inRun = false
+			continue
+		}
+		if !inRun {
+			starts = append(starts, p)
+			inRun, runHasCross = true, k%2 == 0
+		} else if k%2 == 0 && !runHasCross {
+			starts[len(starts)-1] = p
+			runHasCross = true
+		}
+	}
+	return starts
+}
+
+// traceRidge follows the skeleton from start, away from origin and the
+// other branches leaving it, for at most maxLen pixels. It returns the
+// pixels walked, whether it stopped next to a junction, which is not part of
+// the path, rather than on an ending or after maxLen pixels, and where it
+// stopped: the junction, the ending or the pixel after the last one.
+func traceRidge(skeleton *image.Gray, origin, start image.Point, others []image.Point, maxLen int) ([]image.Point, bool, image.Point) {
+	visited := map[image.Point]bool{origin: true}
+	for _, p := range others {
+		visited[p] = true
+	}
+	path := []image.Point{}
+	current := start
+	for len(path) < maxLen {
+		if crossingNumber(skeleton, current.X, current.Y) >= 3 {
+			return path, true, current
+		}
+		path = append(path, current)
+		visited[current] = true
+		next := []image.Point{}
+		for k := 0; k < 8; k++ {
+			p := image.Pt(current.X+nbDx[k], current.Y+nbDy[k])
+			if isRidge(skeleton, p.X, p.Y) && !visited[p] {
+				next = append(next, p)
+			}
+		}
+		if len(next) == 0 {
+			return path, false, current
+		}
+		// a 4-connected step before a diagonal one reaching the same ridge
+		best := next[0]
+		for _, p := range next[1:] {
+			if manhattan(p, current) < manhattan(best, current) {
+				best = p
+			}
+		}
+		for _, p := range next {
+			if p != best && manhattan(p, best) == 1 {
+				visited[p] = true
+			}
+		}
+		current = best
+	}
+	return path, false, current
+}
+
+func manhattan(a, b image.Point) int {
+	dx, dy := a.X-b.X, a.Y-b.Y
+	if dx < 0 {
+		dx = -dx
+	}
+	if dy < 0 {
+		dy = -dy
+	}
+	return dx + dy
+}
+
+func normalizeAngle(a float64) float64 {
+	a = math.Mod(a, 2*math.Pi)
+	if a < 0 {
+		a += 2 * math.Pi
+	}
+	return a
+}
+
+func angleDistance(a, b float64) float64 {
+	d := math.Abs(normalizeAngle(a) - normalizeAngle(b))
+	if d > math.Pi {
+		d = 2*math.Pi - d
+	}
+	return d
+}
+
+// localContrast is the standard deviation of the gray levels around (x, y),
+// scaled so that a well contrasted ridge pattern gives 1.
+func localContrast(img *image.Gray, x, y int) float64 {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	var sum, sumSq, n float64
+	for j := y - minutiaeWindow; j <= y+minutiaeWindow; j++ {
+		for i := x - minutiaeWindow; i <= x+minutiaeWindow; i++ {
+			if i < 0 || j < 0 || i >= w || j >= h {
+				continue
+			}
+			v := float64(img.Pix[j*img.Stride+i])
+			sum += v
+			sumSq += v * v
+			n++
+		}
+	}
+	if n == 0 {
+		return 0
+	}
+	mean := sum / n
+	return math.Min(1, math.Sqrt(math.Max(0, sumSq/n-mean*mean))/64)
+}
+
+// detectMinutiae finds the minutiae of the skeleton on the foreground of
+// mask.
+func detectMinutiae(skeleton, grayImg, mask *image.Gray) []Minutia {
+	minutiae := []Minutia{}
+	w, h := skeleton.Bounds().Dx(), skeleton.Bounds().Dy()
+	for y := minutiaeBorder; y < h-minutiaeBorder; y++ {
+		for x := minutiaeBorder; x < w-minutiaeBorder; x++ {
+			if !isRidge(skeleton, x, y) || mask.Pix[y*mask.Stride+x] == 0 {
+				continue
+			}
+			origin := image.Pt(x, y)
+			var m Minutia
+			switch crossingNumber(skeleton, x, y) {
+			case 1:
+				starts := branchStarts(skeleton, x, y)
+				if len(starts) != 1 {
+					continue
+				}
+				path, _, end := traceRidge(skeleton, origin, starts[0], nil, minutiaeTraceLen)
+				m = Minutia{
+					X: x, Y: y,
+					Type:    RidgeEnding,
+					Angle:   normalizeAngle(math.Atan2(float64(y-end.Y), float64(x-end.X))),
+					Quality: float64(len(path)) / float64(minutiaeTraceLen),
+				}
+			case 3:
+				starts := branchStarts(skeleton, x, y)
+				if len(starts) != 3 {
+					continue
+				}
+				var angles [3]float64
+				completeness := 1.0
+				for i, start := range starts {
+					path, _, end := traceRidge(skeleton, origin, start, starts, minutiaeTraceLen)
+					angles[i] = math.Atan2(float64(end.Y-y), float64(end.X-x))
+					completeness = math.Min(completeness, float64(len(path))/float64(minutiaeTraceLen))
+				}
+				// the two closest branches form the fork, the bifurcation
+				// points along their bisector.
+				a, b := 0, 1
+				for _, pair := range [][2]int{{0, 2}, {1, 2}} {
+					if angleDistance(angles[pair[0]], angles[pair[1]]) < angleDistance(angles[a], angles[b]) {
+						a, b = pair[0], pair[1]
+					}
+				}
+				bisector := math.Atan2(math.Sin(angles[a])+math.Sin(angles[b]), math.Cos(angles[a])+math.Cos(angles[b]))
+				m = Minutia{
+					X: x, Y: y,
+					Type:    RidgeBifurcation,
+					Angle:   normalizeAngle(bisector),
+					Quality: completeness,
+				}
+			default:
+				continue
+			}
+			m.Quality *= localContrast(grayImg, x, y)
+			minutiae = append(minutiae, m)
+		}
+	}
+	return minutiae
+}
+
+// removeFalseMinutiae drops minutiae that sit too close to each other: two
+// endings facing each other are a broken ridge, an ending next to a
+// bifurcation is a spur and two bifurcations are a bridge or a hole.
+func removeFalseMinutiae(minutiae []Minutia) []Minutia {
+	dropped := make([]bool, len(minutiae))
+	for i := 0; i < len(minutiae); i++ {
+		for j := i + 1; j < len(minutiae); j++ {
+			dx := float64(minutiae[i].X - minutiae[j].X)
+			dy := float64(minutiae[i].Y - minutiae[j].Y)
+			if math.Hypot(dx, dy) < float64(minutiaeMinDist) {
+				dropped[i], dropped[j] = true, true
+			}
+		}
+	}
+	kept := []Minutia{}
+	for i, m := range minutiae {
+		if !dropped[i] {
+			kept = append(kept, m)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"image"
+	"image/draw"
+	"reflect"
+	"testing"
+)
+
+// drawSkeleton turns rows of '#' (ridge) and '.' into a skeleton image.
+func drawSkeleton(rows ...string) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, len(rows[0]), len(rows)))
+	for y, row := range rows {
+		for x, c := range row {
+			if c != '#' {
+				img.Pix[y*img.Stride+x] = 255
+			}
+		}
+	}
+	return img
+}
+
+func TestTraceRidge(t *testing.T) {
+	// an ending at (1, 3) whose ridge runs right to a bifurcation at (6, 3)
+	skeleton := drawSkeleton(
+		"..........",
+		".......#..",
+		"......#...",
+		".######...",
+		"......#...",
+		".......#..",
+		"..........",
+	)
+	origin := image.Pt(1, 3)
+	if cn := crossingNumber(skeleton, origin.X, origin.Y); cn != 1 {
+		t.Fatalf("crossing number of the ending is %d, want 1", cn)
+	}
+	starts := branchStarts(skeleton, origin.X, origin.Y)
+	if !reflect.DeepEqual(starts, []image.Point{{2, 3}}) {
+		t.Fatalf("branch starts of the ending %v", starts)
+	}
+
+	path, junction, end := traceRidge(skeleton, origin, starts[0], nil, 10)
+	want := []image.Point{{2, 3}, {3, 3}, {4, 3}, {5, 3}}
+	if !reflect.DeepEqual(path, want) || !junction || end != image.Pt(6, 3) {
+		t.Errorf("path %v, junction %v at %v; want %v, true at (6,3)", path, junction, end, want)
+	}
+
+	// cut short after maxLen pixels
+	path, junction, end = traceRidge(skeleton, origin, starts[0], nil, 2)
+	if len(path) != 2 || junction || end != image.Pt(4, 3) {
+		t.Errorf("maxLen 2: path %v, junction %v at %v", path, junction, end)
+	}
+
+	// from the bifurcation, each branch ends without meeting the others
+	fork := image.Pt(6, 3)
+	starts = branchStarts(skeleton, fork.X, fork.Y)
+	if len(starts) != 3 {
+		t.Fatalf("branch starts of the bifurcation %v", starts)
+	}
+	for _, start := range starts {
+		path, junction, _ := traceRidge(skeleton, fork, start, starts, 10)
+		if junction || len(path) == 0 {
+			t.Errorf("branch from %v: path %v, junction %v", start, path, junction)
+		}
+	}
+}
+
+func TestRemoveSpurs(t *testing.T) {
+	// a ridge with a spur of 2 pixels and a lone pixel
+	skeleton := drawSkeleton(
+		"..........#.",
+		"....#.......",
+		"....#.......",
+		".##########.",
+		"............",
+	)
+	if removed := removeSpurs(skeleton, 4); removed != 2 {
+		t.Errorf("%d branches removed, want 2", removed)
+	}
+	want := drawSkeleton(
+		"............",
+		"............",
+		"............",
+		".##########.",
+		"............",
+	)
+	if !reflect.DeepEqual(skeleton.Pix, want.Pix) {
+		t.Errorf("spur left:\n%v", skeleton.Pix)
+	}
+}
+
+// ridgePrint draws horizontal ridges 4 pixels wide, with a period of 8, and
+// stops the one through the centre halfway: an ending at the centre.
+func ridgePrint(width, height int) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			v := uint8(220)
+			if y%8 < 4 && !(y/8 == height/16 && x > width/2) {
+				v = 30
+			}
+			img.Pix[y*img.Stride+x] = v
+		}
+	}
+	return img
+}
+
+// TestExtractMinutiaeOnPrint checks that the ridges cut by the edge of the
+// print, on a white background, give no minutiae, while the ending inside
+// the print is found.
+func TestExtractMinutiaeOnPrint(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 150, 160))
+	for i := range img.Pix {
+		img.Pix[i] = 255
+	}
+	area := image.Rect(27, 23, 27+96, 23+103)
+	draw.Draw(img, area, ridgePrint(96, 103), image.Point{}, draw.Src)
+
+	// without the mask, the cut ridges end on the edge of the print
+	skeleton, _ := Skeleton(img)
+	all := image.NewGray(img.Rect)
+	for i := range all.Pix {
+		all.Pix[i] = 255
+	}
+	inner := area.Inset(minutiaeBorder)
+	cut := 0
+	for _, m := range detectMinutiae(skeleton, img, all) {
+		if !image.Pt(m.X, m.Y).In(inner) {
+			cut++
+		}
+	}
+	if cut == 0 {
+		t.Fatal("no minutiae on the edge of the print without a mask")
+	}
+
+	minutiae, err := ExtractMinutiae(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ending := area.Min.Add(image.Pt(96/2, 103/16*8+1))
+	near := image.Rect(ending.X-3, ending.Y-3, ending.X+4, ending.Y+4)
+	found := false
+	for _, m := range minutiae {
+		if !image.Pt(m.X, m.Y).In(inner) {
+			t.Errorf("minutia %+v within %d pixels of the background", m, minutiaeBorder)
+		}
+		if m.Type == RidgeEnding && image.Pt(m.X, m.Y).In(near) {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("ending at %v not found among %+v", ending, minutiae)
+	}
+}
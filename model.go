@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Template is the feature vector of one trained image.
+type Template struct {
+	SubjectID string
+	Source    string // file the template was computed from
+	Feature   []float64
+}
+
+// A Model is the content of `model.cache.bin`: the extractor the features were
+// computed with, and the features of every trained image. See modelfile.go
+// for the format on disk.
+type Model struct {
+	Extractor string
+	Params    map[string]string
+	Dim       int
+	// Distance compares features, Threshold is the similarity a probe must
+	// reach to be accepted by -verify. Scale is the distance which scores a
+	// similarity of 0.5, see Calibrate.
+	Distance  string
+	Threshold float64
+	Scale     float64
+	Created   time.Time
+	Modified  time.Time
+	Templates []Template
+}
+
+var defaultThreshold = 0.5
+
+// maxCalibrationScores bounds the scores Calibrate keeps, the gallery is
+// compared with a sample of its templates beyond it.
+var maxCalibrationScores = 1 << 22
+
+// modelTime is the time recorded as Created and Modified. SOURCE_DATE_EPOCH,
+// in seconds, overrides the clock so that training the same images twice
+// gives byte for byte the same model.
+func modelTime() time.Time {
+	if epoch, err := strconv.ParseInt(os.Getenv("SOURCE_DATE_EPOCH"), 10, 64); err == nil {
+		return time.Unix(epoch, 0).UTC()
+	}
+	return time.Now().UTC()
+}
+
+func NewModel(extractor FeatureExtractor, distance string, threshold float64) *Model {
+	return &Model{
+		Extractor: extractor.Name(),
+		Params:    extractor.Params(),
+		Dim:       extractor.Dim(),
+		Distance:  distance,
+		Threshold: threshold,
+		Created:   modelTime(),
+	}
+}
+
+func (m *Model) Add(feature []float64, subjectID, source string) {
+	m.Templates = append(m.Templates, Template{SubjectID: subjectID, Source: source, Feature: feature})
+}
+
+// Enroll adds a template to the model, replacing the one the subject already
+// has from the same source. It reports whether a template was replaced.
+func (m *Model) Enroll(feature []float64, subjectID, source string) (bool, error) {
+	if subjectID == "" || strings.ContainsAny(subjectID, ":\n") {
+		return false, fmt.Errorf("invalid subject ID %q", subjectID)
+	}
+	if strings.ContainsAny(source, ":\n") {
+		return false, fmt.Errorf("invalid template source %q", source)
+	}
+	if len(feature) != m.Dim {
+		return false, fmt.Errorf("feature has %d values, the model holds %d", len(feature), m.Dim)
+	}
+	for i, t := range m.Templates {
+		if t.SubjectID == subjectID && t.Source == source {
+			m.Templates[i].Feature = feature
+			return true, nil
+		}
+	}
+	m.Add(feature, subjectID, source)
+	return false, nil
+}
+
+// NewExtractor builds the extractor the model was trained with.
+func (m *Model) NewExtractor() (FeatureExtractor, error) {
+	extractor, err := NewExtractor(m.Extractor, m.Params)
+	if err != nil {
+		return nil, err
+	}
+	if extractor.Dim() != m.Dim {
+		return nil, fmt.Errorf("model holds %d dimensional features, extractor %s produces %d", m.Dim, m.Extractor, extractor.Dim())
+	}
+	return extractor, nil
+}
+
+// Check fails when the extractor does not produce the features of the model.
+func (m *Model) Check(extractor FeatureExtractor) error {
+	if extractor.Name() != m.Extractor || !sameParams(extractor.Params(), m.Params) {
+		return fmt.Errorf("model was trained with extractor %s [%s], not %s [%s]",
+			m.Extractor, formatParams(m.Params), extractor.Name(), formatParams(extractor.Params()))
+	}
+	return nil
+}
+
+// Similarity is the score of a distance between features of the model. A
+// model saved before the scale was recorded scores raw distances.
+func (m *Model) Similarity(distance float64) float64 {
+	if m.Scale > 0 {
+		distance /= m.Scale
+	}
+	return Similarity(distance)
+}
+
+// Calibrate compares every template with the rest of the gallery, with the
+// closest template of each subject as Evaluate does. Features of the
+// extractors range from units to 1e30, so Scale is set to the median
+// distance of a template to the closest one of another subject: whatever
+// the extractor, a typical impostor then scores 0.5. Unless the threshold
+// is fixed, it is then set where the false accept and false reject rates of
+// those comparisons cross, which needs subjects with several templates.
+// The equal error rate reached there is returned, -1 when the threshold was
+// kept.
+func (m *Model) Calibrate(fixedThreshold bool) (float64, error) {
+	distance, err := DistanceByName(m.Distance)
+	if err != nil {
+		return 0, err
+	}
+	subjectIndex := map[string]int{}
+	for _, t := range m.Templates {
+		if _, ok := subjectIndex[t.SubjectID]; !ok {
+			subjectIndex[t.SubjectID] = len(subjectIndex)
+		}
+	}
+	step := 1
+	if n := len(m.Templates) * len(subjectIndex); n > maxCalibrationScores {
+		step = (n + maxCalibrationScores - 1) / maxCalibrationScores
+	}
+
+	// distances first, the scale is only known once they are all in
+	genuine, impostor, nearest := []float64{}, []float64{}, []float64{}
+	best := make([]float64, len(subjectIndex))
+	for i := 0; i < len(m.Templates); i += step {
+		probe := m.Templates[i]
+		for s := range best {
+			best[s] = math.Inf(1)
+		}
+		for j, t := range m.Templates {
+			if j == i {
+				continue
+			}
+			s := subjectIndex[t.SubjectID]
+			best[s] = math.Min(best[s], distance(t.Feature, probe.Feature))
+		}
+		closest := math.Inf(1)
+		for id, s := range subjectIndex {
+			if math.IsInf(best[s], 1) {
+				continue // the only template of its subject
+			}
+			if id == probe.SubjectID {
+				genuine = append(genuine, best[s])
+			} else {
+				impostor = append(impostor, best[s])
+				closest = math.Min(closest, best[s])
+			}
+		}
+		if !math.IsInf(closest, 1) {
+			nearest = append(nearest, closest)
+		}
+	}
+
+	m.Scale = 1
+	if len(nearest) > 0 {
+		sort.Float64s(nearest)
+		if median := nearest[len(nearest)/2]; median > 0 {
+			m.Scale = median
+		}
+	}
+	if fixedThreshold || len(genuine) == 0 || len(impostor) == 0 {
+		return -1, nil
+	}
+	evaluation := &Evaluation{}
+	for _, d := range genuine {
+		evaluation.Genuine = append(evaluation.Genuine, m.Similarity(d))
+	}
+	for _, d := range impostor {
+		evaluation.Impostor = append(evaluation.Impostor, m.Similarity(d))
+	}
+	eer, threshold := EER(evaluation.Curve())
+	m.Threshold = threshold
+	return eer, nil
+}
+
+// Remove drops every template of the subject and returns how many there were.
+func (m *Model) Remove(subjectID string) int {
+	kept := m.Templates[:0]
+	for _, t := range m.Templates {
+		if t.SubjectID != subjectID {
+			kept = append(kept, t)
+		}
+	}
+	removed := len(m.Templates) - len(kept)
+	m.Templates = kept
+	return removed
+}
+
+// SubjectTemplates returns the templates enrolled for the subject.
+func (m *Model) SubjectTemplates(subjectID string) []Template {
+	templates := []Template{}
+	for _, t := range m.Templates {
+		if t.SubjectID == subjectID {
+			templates = append(templates, t)
+		}
+	}
+	return templates
+}
+
+func (m *Model) sort() {
+	sort.SliceStable(m.Templates, func(i, j int) bool {
+		a, b := m.Templates[i], m.Templates[j]
+		for k := range a.Feature {
+			if a.Feature[k] != b.Feature[k] {
+				return a.Feature[k] < b.Feature[k]
+			}
+		}
+		if a.SubjectID != b.SubjectID {
+			return a.SubjectID < b.SubjectID
+		}
+		return a.Source < b.Source
+	})
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// clusteredModel holds 3 templates for each of 10 subjects, close to the
+// centre of their subject, every value multiplied by magnitude.
+func clusteredModel(magnitude float64, perSubject int) *Model {
+	rng := rand.New(rand.NewSource(1))
+	m := &Model{Distance: "l2", Threshold: defaultThreshold}
+	for s := 0; s < 10; s++ {
+		centre := make([]float64, 4)
+		for i := range centre {
+			centre[i] = rng.Float64() * 10
+		}
+		for n := 0; n < perSubject; n++ {
+			feature := make([]float64, len(centre))
+			for i := range feature {
+				feature[i] = (centre[i] + rng.Float64()*0.1) * magnitude
+			}
+			m.Add(feature, fmt.Sprint(s), fmt.Sprintf("%d_%d", s, n))
+		}
+	}
+	return m
+}
+
+func TestCalibrate(t *testing.T) {
+	var thresholds []float64
+	for _, magnitude := range []float64{1e-3, 1, 1e30} {
+		m := clusteredModel(magnitude, 3)
+		eer, err := m.Calibrate(false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if eer != 0 {
+			t.Errorf("magnitude %g: EER %g of separate subjects", magnitude, eer)
+		}
+		// the closest other template of its subject reaches the threshold,
+		// the closest of another subject does not
+		distance, _ := DistanceByName(m.Distance)
+		for i, a := range m.Templates {
+			best := map[string]float64{}
+			for j, b := range m.Templates {
+				if i != j {
+					best[b.SubjectID] = math.Max(best[b.SubjectID], m.Similarity(distance(a.Feature, b.Feature)))
+				}
+			}
+			for id, score := range best {
+				if genuine := id == a.SubjectID; genuine != (score >= m.Threshold) {
+					t.Fatalf("magnitude %g: %s against subject %s scores %g, threshold %g", magnitude, a.Source, id, score, m.Threshold)
+				}
+			}
+		}
+		thresholds = append(thresholds, m.Threshold)
+	}
+	// the scores do not depend on the magnitude of the features
+	for _, threshold := range thresholds[1:] {
+		if math.Abs(threshold-thresholds[0]) > 1e-6 {
+			t.Errorf("thresholds %v", thresholds)
+		}
+	}
+}
+
+func TestCalibrateKeepsThreshold(t *testing.T) {
+	m := clusteredModel(1e30, 3)
+	m.Threshold = 0.8
+	if eer, err := m.Calibrate(true); err != nil || eer != -1 || m.Threshold != 0.8 {
+		t.Errorf("fixed threshold: EER %g, %v, threshold %g", eer, err, m.Threshold)
+	}
+	if m.Scale < 1e29 {
+		t.Errorf("scale %g of features around 1e30", m.Scale)
+	}
+
+	// no subject with two templates, no genuine comparison to calibrate on
+	m = clusteredModel(1, 1)
+	if eer, err := m.Calibrate(false); err != nil || eer != -1 || m.Threshold != defaultThreshold {
+		t.Errorf("single templates: EER %g, %v, threshold %g", eer, err, m.Threshold)
+	}
+}
+
+func TestModelSimilarity(t *testing.T) {
+	m := &Model{}
+	if got := m.Similarity(3); got != 0.25 {
+		t.Errorf("unscaled similarity of 3: %g", got)
+	}
+	m.Scale = 1e30
+	if got := m.Similarity(1e30); got != 0.5 {
+		t.Errorf("similarity at the scale: %g", got)
+	}
+	if got := m.Similarity(0); got != 1 {
+		t.Errorf("similarity of identical features: %g", got)
+	}
+}
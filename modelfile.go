@@ -0,0 +1,468 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A model file is laid out as follows, integers are little endian:
+//
+//	magic     "BIOMEGO\x00"
+//	version   uint16
+//	header    uint32 length, then the JSON encoded modelHeader
+//	templates header.Templates times:
+//	            uint16 length, then the subject ID
+//	            uint16 length, then the source file name
+//	            header.Dim float64, the feature
+//	checksum  uint32, CRC-32 (IEEE) of everything above
+//
+// The header is self describing: the extractor and all of its parameters,
+// the feature dimensionality and when the model was created. A model whose
+// settings this build cannot reproduce is refused rather than matched.
+//
+// Version 0 is the text format of `model.cache.txt`, still read so that
+// older models keep working until they are written again. Version 1 did not
+// record the distance scale, its models score raw distances.
+const (
+	modelMagic       = "BIOMEGO\x00"
+	modelVersion     = 2
+	maxModelHeader   = 1 << 20
+	maxTemplateField = 1<<16 - 1
+)
+
+type modelHeader struct {
+	Extractor string            `json:"extractor"`
+	Params    map[string]string `json:"params"`
+	Dim       int               `json:"dim"`
+	Distance  string            `json:"distance"`
+	Threshold float64           `json:"threshold"`
+	Scale     float64           `json:"scale"`
+	Templates int               `json:"templates"`
+	Created   time.Time         `json:"created"`
+	Modified  time.Time         `json:"modified"`
+}
+
+// Save writes the model next to its destination then renames it over, so
+// that a crash while saving leaves the previous model untouched.
+func (m *Model) Save(path string) error {
+	m.sort()
+	m.Modified = modelTime()
+	if m.Created.IsZero() {
+		m.Created = m.Modified
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // no-op once renamed
+	defer f.Close()
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	if err := f.Chmod(mode); err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	if err := m.encode(w); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return err
+	}
+	// make the rename itself durable
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+func (m *Model) encode(out io.Writer) error {
+	checksum := crc32.NewIEEE()
+	w := io.MultiWriter(out, checksum)
+
+	header, err := json.Marshal(modelHeader{
+		Extractor: m.Extractor,
+		Params:    m.Params,
+		Dim:       m.Dim,
+		Distance:  m.Distance,
+		Threshold: m.Threshold,
+		Scale:     m.Scale,
+		Templates: len(m.Templates),
+		Created:   m.Created,
+		Modified:  m.Modified,
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, modelMagic); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint16(modelVersion)); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(header))); err != nil {
+		return err
+	}
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	for _, t := range m.Templates {
+		if len(t.Feature) != m.Dim {
+			return fmt.Errorf("template %s of subject %s has %d values, the model holds %d", t.Source, t.SubjectID, len(t.Feature), m.Dim)
+		}
+		if err := writeField(w, t.SubjectID); err != nil {
+			return err
+		}
+		if err := writeField(w, t.Source); err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.LittleEndian, t.Feature); err != nil {
+			return err
+		}
+	}
+	return binary.Write(out, binary.LittleEndian, checksum.Sum32())
+}
+
+func writeField(w io.Writer, s string) error {
+	if len(s) > maxTemplateField {
+		return fmt.Errorf("%.20q... is longer than %d bytes", s, maxTemplateField)
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint16(len(s))); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, s)
+	return err
+}
+
+func LoadModel(path string) (*Model, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(f)
+	magic, err := br.Peek(len(modelMagic))
+	if err != nil || string(magic) != modelMagic {
+		log.Printf("[!] %s is a version 0 text model, it is rewritten in version %d on the next save\n", path, modelVersion)
+		return loadTextModel(path, br)
+	}
+
+	m, err := decodeModel(br, info.Size())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return m, nil
+}
+
+// decodeModel reads a model of size bytes. The header is checked against the
+// size before anything is allocated for the templates, its checksum is only
+// known at the end.
+func decodeModel(br *bufio.Reader, size int64) (*Model, error) {
+	checksum := crc32.NewIEEE()
+	r := io.TeeReader(br, checksum)
+
+	magic := make([]byte, len(modelMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return nil, err
+	}
+	var version uint16
+	if err := binary.Read(r, binary.LittleEndian, &version); err != nil {
+		return nil, err
+	}
+	if version < 1 || version > modelVersion {
+		return nil, fmt.Errorf("model version %d is not supported, this build reads versions up to %d", version, modelVersion)
+	}
+
+	var headerLen uint32
+	if err := binary.Read(r, binary.LittleEndian, &headerLen); err != nil {
+		return nil, err
+	}
+	if headerLen > maxModelHeader {
+		return nil, fmt.Errorf("model header of %d bytes is too large", headerLen)
+	}
+	raw := make([]byte, headerLen)
+	if _, err := io.ReadFull(r, raw); err != nil {
+		return nil, err
+	}
+	var header modelHeader
+	if err := json.Unmarshal(raw, &header); err != nil {
+		return nil, fmt.Errorf("model header: %v", err)
+	}
+	m := &Model{
+		Extractor: header.Extractor,
+		Params:    header.Params,
+		Dim:       header.Dim,
+		Distance:  header.Distance,
+		Threshold: header.Threshold,
+		Scale:     header.Scale,
+		Created:   header.Created,
+		Modified:  header.Modified,
+	}
+	if err := m.checkSettings(); err != nil {
+		return nil, err
+	}
+	if header.Scale < 0 {
+		return nil, fmt.Errorf("invalid distance scale %g", header.Scale)
+	}
+	// a model may be empty, once its last subject was deleted
+	if header.Templates < 0 {
+		return nil, fmt.Errorf("invalid number of templates %d", header.Templates)
+	}
+	// every template takes the lengths of its two fields and its feature
+	remaining := size - int64(len(modelMagic)+2+4) - int64(headerLen) - 4
+	if remaining < 0 {
+		remaining = 0 // truncated, the checksum is missing
+	}
+	if maxTemplates := remaining / int64(4+8*header.Dim); int64(header.Templates) > maxTemplates {
+		return nil, fmt.Errorf("model header gives %d templates, the file holds at most %d", header.Templates, maxTemplates)
+	}
+
+	m.Templates = make([]Template, header.Templates)
+	features := make([]float64, header.Templates*header.Dim)
+	for i := range m.Templates {
+		t := &m.Templates[i]
+		var err error
+		if t.SubjectID, err = readField(r); err != nil {
+			return nil, fmt.Errorf("template %d: %v", i, err)
+		}
+		if t.Source, err = readField(r); err != nil {
+			return nil, fmt.Errorf("template %d: %v", i, err)
+		}
+		t.Feature = features[i*header.Dim : (i+1)*header.Dim : (i+1)*header.Dim]
+		if err := binary.Read(r, binary.LittleEndian, t.Feature); err != nil {
+			return nil, fmt.Errorf("template %d: %v", i, err)
+		}
+	}
+
+	sum := checksum.Sum32()
+	var stored uint32
+	if err := binary.Read(br, binary.LittleEndian, &stored); err != nil {
+		return nil, fmt.Errorf("checksum: %v", err)
+	}
+	if stored != sum {
+		return nil, fmt.Errorf("checksum mismatch, the model is corrupted")
+	}
+	if _, err := br.ReadByte(); err != io.EOF {
+		return nil, fmt.Errorf("unexpected data after the checksum")
+	}
+	return m, nil
+}
+
+func readField(r io.Reader) (string, error) {
+	var n uint16
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return "", err
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// checkSettings fails loudly when this build would not compute the features
+// of the model the same way: unknown extractor, different parameters, such
+// as another Sobel kernel, or another dimensionality.
+func (m *Model) checkSettings() error {
+	extractor, err := NewExtractor(m.Extractor, m.Params)
+	if err != nil {
+		return fmt.Errorf("model was built with settings this build cannot reproduce: %v", err)
+	}
+	if !sameParams(extractor.Params(), m.Params) {
+		return fmt.Errorf("model was built with extractor %s [%s], this build would use [%s]",
+			m.Extractor, formatParams(m.Params), formatParams(extractor.Params()))
+	}
+	if extractor.Dim() != m.Dim {
+		return fmt.Errorf("model holds %d dimensional features, extractor %s produces %d", m.Dim, m.Extractor, extractor.Dim())
+	}
+	if _, err := DistanceByName(m.Distance); err != nil {
+		return err
+	}
+	return nil
+}
+
+// loadTextModel reads the version 0 text format:
+//
+//	# extractor sobel-topn digestLen=25
+//	# matcher distance=l2 threshold=0.5
+//	f1,f2,...,fn:subjectID:source
+//
+// Files written before the header existed hold one `digest:subjectID` per
+// line, they were built by the default sobel-histogram extractor.
+func loadTextModel(path string, r io.Reader) (*Model, error) {
+	m := &Model{Distance: defaultDistance, Threshold: defaultThreshold}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	lineNo := 0
+	inHeader := true
+	for scanner.Scan() {
+		line := scanner.Text()
+		lineNo++
+		if strings.HasPrefix(line, "#") {
+			if !inHeader {
+				return nil, fmt.Errorf("%s:%d: header line after the templates", path, lineNo)
+			}
+			if err := m.parseTextHeader(line); err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", path, lineNo, err)
+			}
+			continue
+		}
+		if inHeader {
+			inHeader = false
+			if m.Extractor == "" {
+				log.Printf("[!] %s has no header, assuming extractor %s\n", path, defaultExtractor)
+				m.Extractor = defaultExtractor
+			}
+			// version 0 did not record every setting, the ones missing are
+			// assumed to be those of this build.
+			extractor, err := NewExtractor(m.Extractor, m.Params)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", path, err)
+			}
+			m.Params, m.Dim = extractor.Params(), extractor.Dim()
+		}
+
+		entry := strings.SplitN(line, ":", 3)
+		if len(entry) < 2 {
+			return nil, fmt.Errorf("%s:%d: invalid entry %q", path, lineNo, line)
+		}
+		values := strings.Split(entry[0], ",")
+		if len(values) != m.Dim {
+			return nil, fmt.Errorf("%s:%d: expected %d values, got %d", path, lineNo, m.Dim, len(values))
+		}
+		feature := make([]float64, len(values))
+		for i, v := range values {
+			var err error
+			if feature[i], err = strconv.ParseFloat(v, 64); err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", path, lineNo, err)
+			}
+		}
+		source := ""
+		if len(entry) == 3 {
+			source = entry[2]
+		}
+		m.Add(feature, entry[1], source)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(m.Templates) == 0 {
+		return nil, fmt.Errorf("%s: model is empty", path)
+	}
+	m.sort()
+	return m, nil
+}
+
+// parseTextHeader reads one `# key value...` line of a version 0 header.
+func (m *Model) parseTextHeader(line string) error {
+	fields := strings.Fields(strings.TrimPrefix(line, "#"))
+	if len(fields) == 0 {
+		return fmt.Errorf("empty header line")
+	}
+	switch fields[0] {
+	case "extractor":
+		if len(fields) < 2 {
+			return fmt.Errorf("invalid extractor header %q", line)
+		}
+		m.Extractor = fields[1]
+		m.Params = make(map[string]string)
+		for _, pair := range fields[2:] {
+			k, v, err := parseParam(pair)
+			if err != nil {
+				return err
+			}
+			m.Params[k] = v
+		}
+	case "matcher":
+		for _, pair := range fields[1:] {
+			k, v, err := parseParam(pair)
+			if err != nil {
+				return err
+			}
+			switch k {
+			case "distance":
+				if _, err := DistanceByName(v); err != nil {
+					return err
+				}
+				m.Distance = v
+			case "threshold":
+				if m.Threshold, err = strconv.ParseFloat(v, 64); err != nil {
+					return fmt.Errorf("threshold: %v", err)
+				}
+			default:
+				return fmt.Errorf("unknown matcher setting %q", k)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown header %q", fields[0])
+	}
+	return nil
+}
+
+// loadModelCache reads `model.cache.bin`, or the text `model.cache.txt` of
+// older versions when no binary model was saved yet.
+func loadModelCache() (*Model, error) {
+	m, err := LoadModel(model_cache_file)
+	if os.IsNotExist(err) {
+		if legacy, legacyErr := LoadModel(legacy_model_cache_file); !os.IsNotExist(legacyErr) {
+			return legacy, legacyErr
+		}
+	}
+	return m, err
+}
+
+// loadGallery loads the model to search, which must hold templates.
+func loadGallery() (*Model, error) {
+	m, err := loadModelCache()
+	if err != nil {
+		return nil, err
+	}
+	if len(m.Templates) == 0 {
+		return nil, fmt.Errorf("the gallery of %s is empty, -enroll subjects first", model_cache_file)
+	}
+	return m, nil
+}
+
+// saveModelCache writes `model.cache.bin`. The text model it replaces is
+// removed, so that no stale copy of the templates, e.g. of a deleted subject,
+// is left behind.
+func saveModelCache(m *Model) error {
+	if err := m.Save(model_cache_file); err != nil {
+		return err
+	}
+	if err := os.Remove(legacy_model_cache_file); err == nil {
+		log.Printf("[!] %s migrated to %s and removed\n", legacy_model_cache_file, model_cache_file)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestModelSaveLoad(t *testing.T) {
+	extractor, err := NewExtractor("sobel-hist256", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewModel(extractor, "l2", 0.5)
+	m.Scale = 2.5
+	for i, subject := range []string{"2", "1", "2"} {
+		feature := make([]float64, extractor.Dim())
+		feature[i] = 1
+		m.Add(feature, subject, "image"+subject+string(rune('a'+i)))
+	}
+	path := filepath.Join(t.TempDir(), "model.cache.bin")
+
+	// down to the empty model left by deleting the last subject
+	for _, subject := range []string{"", "2", "1"} {
+		m.Remove(subject)
+		if err := m.Save(path); err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := LoadModel(path)
+		if err != nil {
+			t.Fatalf("%d templates: %v", len(m.Templates), err)
+		}
+		if len(loaded.Templates) != len(m.Templates) {
+			t.Fatalf("%d templates read, %d saved", len(loaded.Templates), len(m.Templates))
+		}
+		for i := range m.Templates {
+			if !reflect.DeepEqual(loaded.Templates[i], m.Templates[i]) {
+				t.Errorf("template %d: %+v, saved %+v", i, loaded.Templates[i], m.Templates[i])
+			}
+		}
+		if loaded.Extractor != m.Extractor || !sameParams(loaded.Params, m.Params) {
+			t.Errorf("extractor %s %v, saved %s %v", loaded.Extractor, loaded.Params, m.Extractor, m.Params)
+		}
+		if loaded.Threshold != m.Threshold || loaded.Scale != m.Scale {
+			t.Errorf("threshold %g and scale %g, saved %g and %g", loaded.Threshold, loaded.Scale, m.Threshold, m.Scale)
+		}
+	}
+}
+
+// rawModel lays out a model file around a header, with a valid checksum.
+func rawModel(version uint16, header modelHeader, payload []byte) []byte {
+	var b bytes.Buffer
+	b.WriteString(modelMagic)
+	binary.Write(&b, binary.LittleEndian, version)
+	raw, _ := json.Marshal(header)
+	binary.Write(&b, binary.LittleEndian, uint32(len(raw)))
+	b.Write(raw)
+	b.Write(payload)
+	binary.Write(&b, binary.LittleEndian, crc32.ChecksumIEEE(b.Bytes()))
+	return b.Bytes()
+}
+
+func TestLoadModelInvalid(t *testing.T) {
+	extractor, err := NewExtractor("sobel-hist256", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := modelHeader{Extractor: extractor.Name(), Params: extractor.Params(), Dim: extractor.Dim(), Distance: "l2", Threshold: 0.5}
+	template := func(subjectID, source string) []byte {
+		var b bytes.Buffer
+		writeField(&b, subjectID)
+		writeField(&b, source)
+		binary.Write(&b, binary.LittleEndian, make([]float64, extractor.Dim()))
+		return b.Bytes()
+	}
+	with := func(edit func(h *modelHeader)) modelHeader {
+		h := header
+		edit(&h)
+		return h
+	}
+	one := template("1", "1.bmp")
+	valid := rawModel(modelVersion, with(func(h *modelHeader) { h.Templates = 1; h.Scale = 2 }), one)
+	corrupted := append([]byte(nil), valid...)
+	corrupted[len(corrupted)-10] ^= 1
+
+	tests := []struct {
+		name string
+		data []byte
+		err  string // "" when the model loads
+	}{
+		{"valid", valid, ""},
+		{"version 1, without a scale", rawModel(1, with(func(h *modelHeader) { h.Templates = 1 }), one), ""},
+		{"huge template count", rawModel(modelVersion, with(func(h *modelHeader) { h.Templates = 4000000000000 }), one), "the file holds at most 1"},
+		{"overflowing template count", rawModel(modelVersion, with(func(h *modelHeader) { h.Templates = math.MaxInt64 }), one), "the file holds at most 1"},
+		{"missing template", rawModel(modelVersion, with(func(h *modelHeader) { h.Templates = 2 }), one), "the file holds at most 1"},
+		{"negative template count", rawModel(modelVersion, with(func(h *modelHeader) { h.Templates = -1 }), nil), "invalid number of templates"},
+		{"negative scale", rawModel(modelVersion, with(func(h *modelHeader) { h.Scale = -1 }), nil), "invalid distance scale"},
+		{"other dimension", rawModel(modelVersion, with(func(h *modelHeader) { h.Dim = 3 }), nil), "produces 256"},
+		{"unknown version", rawModel(modelVersion+1, header, nil), "not supported"},
+		{"corrupted feature", corrupted, "checksum mismatch"},
+		{"truncated", valid[:len(valid)-2], "checksum"},
+	}
+	dir := t.TempDir()
+	for _, tt := range tests {
+		path := filepath.Join(dir, "model.cache.bin")
+		if err := os.WriteFile(path, tt.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		m, err := LoadModel(path)
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case tt.err == "" && len(m.Templates) != 1:
+			t.Errorf("%s: %d templates", tt.name, len(m.Templates))
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%s: error %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+const (
+	defaultOrientationBlock  = 8
+	defaultOrientationSmooth = 1.0 // blocks
+)
+
+// An OrientationField is the direction of the ridges in every block of
+// Block x Block pixels of an image, row by row. Angle is in radians within
+// [0, π), measured in image coordinates (y grows downwards) like the angles
+// of the minutiae; Coherence is in [0, 1], 1 when all the gradients of the
+// block are parallel and 0 when they point every way or it is flat.
+type OrientationField struct {
+	Rect          image.Rectangle // of the image
+	Block         int
+	Width, Height int // in blocks
+	Angle         []float64
+	Coherence     []float64
+}
+
+// EstimateOrientation computes the orientation field of img from its Sobel
+// gradients, as Kass and Witkin (1987): the squared gradients of a block
+// are summed as the vector (Gxx-Gyy, 2Gxy), whose angle is twice the one of
+// the gradient, so that opposite gradients on both sides of a ridge add up
+// instead of cancelling. The ridges run across the gradient. The vectors are
+// then smoothed by a Gaussian of smooth blocks, 0 for none, which averages
+// the orientation over blocks damaged by scars or noise; the coherence is
+// the one of the block alone, so that it still tells such blocks apart.
+func EstimateOrientation(img *image.Gray, block int, smooth float64) *OrientationField {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	f := &OrientationField{
+		Rect:   img.Rect,
+		Block:  block,
+		Width:  (w + block - 1) / block,
+		Height: (h + block - 1) / block,
+	}
+	f.Angle = make([]float64, f.Width*f.Height)
+	f.Coherence = make([]float64, f.Width*f.Height)
+	if w == 0 || h == 0 {
+		return f
+	}
+
+	gxx, gyy, gxy := blockGradients(img, block)
+	vx, vy, energy := make([]float64, len(gxx)), make([]float64, len(gxx)), make([]float64, len(gxx))
+	for i := range gxx {
+		vx[i], vy[i], energy[i] = gxx[i]-gyy[i], 2*gxy[i], gxx[i]+gyy[i]
+	}
+	for i := range f.Coherence {
+		if energy[i] > 0 {
+			f.Coherence[i] = math.Min(math.Hypot(vx[i], vy[i])/energy[i], 1)
+		}
+	}
+	if smooth > 0 {
+		vx = smoothBlocks(vx, f.Width, f.Height, smooth)
+		vy = smoothBlocks(vy, f.Width, f.Height, smooth)
+	}
+	for i := range f.Angle {
+		f.Angle[i] = normalizeOrientation(math.Atan2(vy[i], vx[i])/2 + math.Pi/2)
+	}
+	return f
+}
+
+// normalizeOrientation brings an orientation into [0, π).
+func normalizeOrientation(a float64) float64 {
+	a = math.Mod(a, math.Pi)
+	if a < 0 {
+		a += math.Pi
+	}
+	return a
+}
+
+// At returns the orientation and the coherence of the block of the pixel
+// (x, y), in image coordinates, both 0 outside of the image.
+func (f *OrientationField) At(x, y int) (float64, float64) {
+	if !image.Pt(x, y).In(f.Rect) {
+		return 0, 0
+	}
+	bx, by := (x-f.Rect.Min.X)/f.Block, (y-f.Rect.Min.Y)/f.Block
+	i := by*f.Width + bx
+	return f.Angle[i], f.Coherence[i]
+}
+
+// smoothBlocks convolves a grid of bw x bh values with a Gaussian of sigma
+// blocks, one dimension then the other, replicating the edges.
+func smoothBlocks(values []float64, bw, bh int, sigma float64) []float64 {
+	radius := int(math.Ceil(3 * sigma))
+	weights := make([]float64, 2*radius+1)
+	var total float64
+	for i := range weights {
+		d := float64(i - radius)
+		weights[i] = math.Exp(-d * d / (2 * sigma * sigma))
+		total += weights[i]
+	}
+	for i := range weights {
+		weights[i] /= total
+	}
+	clamp := func(v, n int) int {
+		if v < 0 {
+			return 0
+		} else if v >= n {
+			return n - 1
+		}
+		return v
+	}
+
+	tmp := make([]float64, len(values))
+	for y := 0; y < bh; y++ {
+		for x := 0; x < bw; x++ {
+			var sum float64
+			for i, wt := range weights {
+				sum += wt * values[y*bw+clamp(x+i-radius, bw)]
+			}
+			tmp[y*bw+x] = sum
+		}
+	}
+	out := make([]float64, len(values))
+	for y := 0; y < bh; y++ {
+		for x := 0; x < bw; x++ {
+			var sum float64
+			for i, wt := range weights {
+				sum += wt * tmp[clamp(y+i-radius, bh)*bw+x]
+			}
+			out[y*bw+x] = sum
+		}
+	}
+	return out
+}
+
+// Overlay draws the field over img, enlarged scale times: a line along the
+// ridges through the centre of every block, red where the orientation is
+// coherent fading to blue where it is not. Flat blocks are left blank.
+func (f *OrientationField) Overlay(img *image.Gray, scale int) *image.RGBA {
+	r := img.Rect
+	out := image.NewRGBA(image.Rect(0, 0, r.Dx()*scale, r.Dy()*scale))
+	for y := 0; y < out.Rect.Dy(); y++ {
+		for x := 0; x < out.Rect.Dx(); x++ {
+			g := img.Pix[img.PixOffset(r.Min.X+x/scale, r.Min.Y+y/scale)]
+			out.SetRGBA(x, y, color.RGBA{g, g, g, 255})
+		}
+	}
+
+	half := 0.4 * float64(f.Block*scale)
+	for by := 0; by < f.Height; by++ {
+		for bx := 0; bx < f.Width; bx++ {
+			i := by*f.Width + bx
+			c := f.Coherence[i]
+			if c == 0 {
+				continue
+			}
+			line := color.RGBA{uint8(255 * c), 0, uint8(255 * (1 - c)), 255}
+			// the centre of the block, which may be cut by the edge of the image
+			cx := (float64(bx*f.Block) + math.Min(float64((bx+1)*f.Block), float64(r.Dx()))) / 2 * float64(scale)
+			cy := (float64(by*f.Block) + math.Min(float64((by+1)*f.Block), float64(r.Dy()))) / 2 * float64(scale)
+			dx, dy := math.Cos(f.Angle[i]), math.Sin(f.Angle[i])
+			for t := -half; t <= half; t += 0.5 {
+				out.SetRGBA(int(cx+t*dx), int(cy+t*dy), line)
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// stripes draws straight ridges running at angle, in image coordinates, with
+// a period of period pixels across them and some noise.
+func stripes(r image.Rectangle, angle, period, noise float64, seed int64) *image.Gray {
+	rng := rand.New(rand.NewSource(seed))
+	img := image.NewGray(r)
+	nx, ny := -math.Sin(angle), math.Cos(angle) // across the ridges
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			d := float64(x)*nx + float64(y)*ny
+			img.SetGray(x, y, color.Gray{Y: clampUint8(128 + 90*math.Cos(2*math.Pi*d/period) + noise*rng.NormFloat64())})
+		}
+	}
+	return img
+}
+
+// orientationError is the difference of two orientations, in [0, π/2].
+func orientationError(a, b float64) float64 {
+	d := math.Mod(math.Abs(a-b), math.Pi)
+	return math.Min(d, math.Pi-d)
+}
+
+func TestEstimateOrientation(t *testing.T) {
+	r := image.Rect(-5, 10, 91, 106)
+	for _, degrees := range []float64{0, 30, 45, 90, 120, 160} {
+		angle := degrees * math.Pi / 180
+		img := stripes(r, angle, 9, 10, 1)
+		for _, smooth := range []float64{0, defaultOrientationSmooth} {
+			f := EstimateOrientation(img, 8, smooth)
+			if f.Width != 12 || f.Height != 12 {
+				t.Fatalf("%d x %d blocks", f.Width, f.Height)
+			}
+			// the blocks on the border see the edge of the image
+			for y := r.Min.Y + 8; y < r.Max.Y-8; y += 8 {
+				for x := r.Min.X + 8; x < r.Max.X-8; x += 8 {
+					a, coherence := f.At(x, y)
+					if e := orientationError(a, angle); e > 5*math.Pi/180 || coherence < 0.7 {
+						t.Fatalf("ridges at %g°, smooth %g: block of (%d, %d) at %.1f°, coherence %.2f", degrees, smooth, x, y, a*180/math.Pi, coherence)
+					}
+					if a < 0 || a >= math.Pi {
+						t.Fatalf("angle %g out of [0, π)", a)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestEstimateOrientationCoherence(t *testing.T) {
+	r := image.Rect(0, 0, 64, 64)
+	flat := image.NewGray(r)
+	for i := range flat.Pix {
+		flat.Pix[i] = 90
+	}
+	noise := image.NewGray(r)
+	rand.New(rand.NewSource(2)).Read(noise.Pix)
+
+	for _, tt := range []struct {
+		name string
+		img  *image.Gray
+		max  float64
+	}{
+		{"flat", flat, 0},
+		{"noise", noise, 0.4},
+	} {
+		f := EstimateOrientation(tt.img, 8, defaultOrientationSmooth)
+		var mean float64
+		for _, c := range f.Coherence {
+			mean += c
+		}
+		if mean /= float64(len(f.Coherence)); mean > tt.max {
+			t.Errorf("%s: mean coherence %.2f, want at most %g", tt.name, mean, tt.max)
+		}
+	}
+
+	// outside of the image there is no orientation
+	f := EstimateOrientation(stripes(r, 0, 9, 0, 1), 8, 0)
+	if a, c := f.At(-1, 10); a != 0 || c != 0 {
+		t.Errorf("outside: %g, %g", a, c)
+	}
+}
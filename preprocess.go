@@ -0,0 +1,317 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// The preprocessing of the Sobel extractors evens out the contrast of the
+// gray image before the Sobel kernels, so that the histogram of their
+// response depends less on the sensor gain, the pressure of the finger or
+// how dry it was:
+//
+//   - normalize: every image gets the same mean and variance
+//   - equalize: global histogram equalization
+//   - clahe: contrast limited adaptive histogram equalization, per tile of a
+//     claheTiles x claheTiles grid, each histogram clipped at claheClip times
+//     its average bin
+//   - gabor: ridge enhancement by Gabor kernels tuned to the orientation and
+//     frequency of the ridges of every gaborBlock x gaborBlock block, with an
+//     envelope of gaborSigma pixels, see enhance.go
+var preprocessMethods = []string{"none", "normalize", "equalize", "clahe", "gabor"}
+
+// the parameters of each method
+var preprocessParams = map[string][]string{
+	"clahe": {"claheTiles", "claheClip"},
+	"gabor": {"gaborBlock", "gaborSigma"},
+}
+
+const (
+	normalizeMean = 128
+	normalizeStd  = 64
+
+	defaultClaheTiles = 8
+	defaultClaheClip  = 2.0
+)
+
+// preprocessing is the `preprocess` parameter, with the parameters of its
+// method. None is not recorded, as in the models of older versions.
+type preprocessing struct {
+	method string
+	tiles  int
+	clip   float64
+	block  int
+	sigma  float64
+}
+
+func preprocessParam(params map[string]string) (*preprocessing, error) {
+	p := &preprocessing{method: "none", tiles: defaultClaheTiles, clip: defaultClaheClip, block: defaultGaborBlock, sigma: defaultGaborSigma}
+	if v, ok := params["preprocess"]; ok {
+		p.method = v
+	}
+	found := false
+	for _, m := range preprocessMethods {
+		found = found || m == p.method
+	}
+	if !found {
+		return nil, fmt.Errorf("parameter preprocess must be one of %s, got %q", strings.Join(preprocessMethods, ", "), p.method)
+	}
+	for method, keys := range preprocessParams {
+		if method == p.method {
+			continue
+		}
+		for _, k := range keys {
+			if _, ok := params[k]; ok {
+				return nil, fmt.Errorf("parameter %s needs preprocess=%s", k, method)
+			}
+		}
+	}
+
+	var err error
+	switch p.method {
+	case "clahe":
+		if p.tiles, err = intParam(params, "claheTiles", defaultClaheTiles); err != nil {
+			return nil, err
+		}
+		if p.tiles < 1 || p.tiles > 64 {
+			return nil, fmt.Errorf("parameter claheTiles must be within [1, 64], got %d", p.tiles)
+		}
+		if p.clip, err = floatParam(params, "claheClip", defaultClaheClip); err != nil {
+			return nil, err
+		}
+		if p.clip < 1 {
+			return nil, fmt.Errorf("parameter claheClip must be at least 1, got %g", p.clip)
+		}
+	case "gabor":
+		if p.block, err = intParam(params, "gaborBlock", defaultGaborBlock); err != nil {
+			return nil, err
+		}
+		if p.block < 4 || p.block > 64 {
+			return nil, fmt.Errorf("parameter gaborBlock must be within [4, 64], got %d", p.block)
+		}
+		if p.sigma, err = floatParam(params, "gaborSigma", defaultGaborSigma); err != nil {
+			return nil, err
+		}
+		if p.sigma < 0.5 || p.sigma > 16 {
+			return nil, fmt.Errorf("parameter gaborSigma must be within [0.5, 16], got %g", p.sigma)
+		}
+	}
+	return p, nil
+}
+
+func (p *preprocessing) addParams(params map[string]string) map[string]string {
+	if p.method == "none" {
+		return params
+	}
+	params["preprocess"] = p.method
+	switch p.method {
+	case "clahe":
+		params["claheTiles"] = strconv.Itoa(p.tiles)
+		params["claheClip"] = strconv.FormatFloat(p.clip, 'g', -1, 64)
+	case "gabor":
+		params["gaborBlock"] = strconv.Itoa(p.block)
+		params["gaborSigma"] = strconv.FormatFloat(p.sigma, 'g', -1, 64)
+	}
+	return params
+}
+
+func (p *preprocessing) apply(img *image.Gray) *image.Gray {
+	switch p.method {
+	case "normalize":
+		return NormalizeGray(img, normalizeMean, normalizeStd*normalizeStd)
+	case "equalize":
+		return EqualizeGray(img)
+	case "clahe":
+		return CLAHE(img, p.tiles, p.clip)
+	case "gabor":
+		return GaborEnhance(img, p.block, p.sigma)
+	}
+	return img
+}
+
+// grayPixels calls f with every pixel of img, row by row.
+func grayPixels(img *image.Gray, f func(p *uint8)) {
+	for y := img.Rect.Min.Y; y < img.Rect.Max.Y; y++ {
+		row := img.Pix[img.PixOffset(img.Rect.Min.X, y):][:img.Rect.Dx()]
+		for x := range row {
+			f(&row[x])
+		}
+	}
+}
+
+// NormalizeGray gives the image the mean and variance requested, pixel by
+// pixel as Hong, Wan and Jain (1998) do before estimating ridge orientations.
+func NormalizeGray(img *image.Gray, mean, variance float64) *image.Gray {
+	var sum, ssq, n float64
+	grayPixels(img, func(p *uint8) {
+		sum += float64(*p)
+		ssq += float64(*p) * float64(*p)
+		n++
+	})
+	out := image.NewGray(img.Rect)
+	if n == 0 {
+		return out
+	}
+	m := sum / n
+	v := ssq/n - m*m
+	i := 0
+	grayPixels(img, func(p *uint8) {
+		g := mean
+		if v > 0 {
+			d := math.Sqrt(variance * (float64(*p) - m) * (float64(*p) - m) / v)
+			if float64(*p) > m {
+				g += d
+			} else {
+				g -= d
+			}
+		}
+		out.Pix[i] = clampUint8(g)
+		i++
+	})
+	return out
+}
+
+// EqualizeGray spreads the cumulative histogram of the image over [0, 255].
+func EqualizeGray(img *image.Gray) *image.Gray {
+	var histogram [256]int
+	grayPixels(img, func(p *uint8) { histogram[*p]++ })
+	lut := equalizationLUT(histogram, img.Rect.Dx()*img.Rect.Dy())
+	out := image.NewGray(img.Rect)
+	i := 0
+	grayPixels(img, func(p *uint8) {
+		out.Pix[i] = lut[*p]
+		i++
+	})
+	return out
+}
+
+func equalizationLUT(histogram [256]int, n int) [256]uint8 {
+	var lut [256]uint8
+	cdf, cdfMin := 0, 0
+	for _, c := range histogram {
+		if c > 0 {
+			cdfMin = c
+			break
+		}
+	}
+	for v, c := range histogram {
+		cdf += c
+		if n == cdfMin {
+			lut[v] = uint8(v) // a flat image is left alone
+			continue
+		}
+		lut[v] = clampUint8(float64(cdf-cdfMin) * 255 / float64(n-cdfMin))
+	}
+	return lut
+}
+
+// CLAHE equalizes the histogram of every tile of a tiles x tiles grid, clipped
+// at clip times its average bin with the excess spread over all bins, and
+// interpolates bilinearly between the mappings of the 4 nearest tiles.
+func CLAHE(img *image.Gray, tiles int, clip float64) *image.Gray {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	out := image.NewGray(img.Rect)
+	if w == 0 || h == 0 {
+		return out
+	}
+	nx, ny := tiles, tiles
+	if nx > w {
+		nx = w
+	}
+	if ny > h {
+		ny = h
+	}
+	pixel := func(x, y int) uint8 { return img.Pix[img.PixOffset(img.Rect.Min.X+x, img.Rect.Min.Y+y)] }
+
+	// the mapping of every tile, and the centre of its columns and rows
+	luts := make([][256]uint8, nx*ny)
+	for ty := 0; ty < ny; ty++ {
+		y0, y1 := ty*h/ny, (ty+1)*h/ny
+		for tx := 0; tx < nx; tx++ {
+			x0, x1 := tx*w/nx, (tx+1)*w/nx
+			var histogram [256]int
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					histogram[pixel(x, y)]++
+				}
+			}
+			area := (x1 - x0) * (y1 - y0)
+			limit := int(clip * float64(area) / 256)
+			if limit < 1 {
+				limit = 1
+			}
+			excess := 0
+			for v, c := range histogram {
+				if c > limit {
+					excess += c - limit
+					histogram[v] = limit
+				}
+			}
+			for v := range histogram {
+				histogram[v] += excess / 256
+				if v < excess%256 {
+					histogram[v]++
+				}
+			}
+			cdf := 0
+			for v, c := range histogram {
+				cdf += c
+				luts[ty*nx+tx][v] = clampUint8(float64(cdf) * 255 / float64(area))
+			}
+		}
+	}
+	centre := func(i, n, size int) float64 {
+		return (float64(i*size/n) + float64((i+1)*size/n) - 1) / 2
+	}
+	// neighbours returns the tiles on both sides of a coordinate and the
+	// weight of the second one
+	neighbours := func(c, n, size int) (int, int, float64) {
+		for i := 0; i < n-1; i++ {
+			c0, c1 := centre(i, n, size), centre(i+1, n, size)
+			if float64(c) < c1 {
+				t := (float64(c) - c0) / (c1 - c0)
+				if t < 0 {
+					t = 0
+				}
+				return i, i + 1, t
+			}
+		}
+		return n - 1, n - 1, 0
+	}
+
+	type neighbour struct {
+		t0, t1 int
+		f      float64
+	}
+	columns := make([]neighbour, w)
+	for x := range columns {
+		c := &columns[x]
+		c.t0, c.t1, c.f = neighbours(x, nx, w)
+	}
+	for y := 0; y < h; y++ {
+		ty0, ty1, fy := neighbours(y, ny, h)
+		row := out.Pix[out.PixOffset(img.Rect.Min.X, img.Rect.Min.Y+y):]
+		for x := 0; x < w; x++ {
+			tx0, tx1, fx := columns[x].t0, columns[x].t1, columns[x].f
+			v := pixel(x, y)
+			top := (1-fx)*float64(luts[ty0*nx+tx0][v]) + fx*float64(luts[ty0*nx+tx1][v])
+			bottom := (1-fx)*float64(luts[ty1*nx+tx0][v]) + fx*float64(luts[ty1*nx+tx1][v])
+			row[x] = clampUint8((1-fy)*top + fy*bottom)
+		}
+	}
+	return out
+}
+
+// clampUint8 rounds v to the nearest integer in [0, 255].
+func clampUint8(v float64) uint8 {
+	switch {
+	case v >= 254.5:
+		return 255
+	case v > 0:
+		return uint8(v + 0.5)
+	}
+	return 0
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"image"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// randomGray fills an image with levels drawn in [low, high].
+func randomGray(r image.Rectangle, low, high int, seed int64) *image.Gray {
+	rng := rand.New(rand.NewSource(seed))
+	img := image.NewGray(r)
+	for i := range img.Pix {
+		img.Pix[i] = uint8(low + rng.Intn(high-low+1))
+	}
+	return img
+}
+
+// checkMonotone fails when two pixels of the same level in img get different
+// levels in out, or when a darker pixel gets a brighter level.
+func checkMonotone(t *testing.T, name string, img, out *image.Gray) {
+	t.Helper()
+	var lut [256]int
+	for i := range lut {
+		lut[i] = -1
+	}
+	for i, p := range img.Pix {
+		if lut[p] >= 0 && lut[p] != int(out.Pix[i]) {
+			t.Fatalf("%s: level %d becomes %d and %d", name, p, lut[p], out.Pix[i])
+		}
+		lut[p] = int(out.Pix[i])
+	}
+	last := -1
+	for v, o := range lut {
+		if o < 0 {
+			continue
+		}
+		if o < last {
+			t.Fatalf("%s: level %d becomes %d, below %d of a darker level", name, v, o, last)
+		}
+		last = o
+	}
+}
+
+func meanStd(pix []uint8) (float64, float64) {
+	var sum, ssq float64
+	for _, p := range pix {
+		sum += float64(p)
+		ssq += float64(p) * float64(p)
+	}
+	n := float64(len(pix))
+	return sum / n, math.Sqrt(ssq/n - sum*sum/n/n)
+}
+
+func TestNormalizeGray(t *testing.T) {
+	for _, r := range []image.Rectangle{image.Rect(0, 0, 64, 48), image.Rect(-10, 5, 30, 40)} {
+		img := randomGray(r, 100, 130, 1)
+		out := NormalizeGray(img, normalizeMean, normalizeStd*normalizeStd)
+		if out.Rect != r {
+			t.Errorf("bounds %v, want %v", out.Rect, r)
+		}
+		if mean, std := meanStd(out.Pix); math.Abs(mean-normalizeMean) > 1 || math.Abs(std-normalizeStd) > 1 {
+			t.Errorf("%v: mean %g and std %g, want %d and %d", r, mean, std, normalizeMean, normalizeStd)
+		}
+		checkMonotone(t, "normalize", img, out)
+	}
+
+	flat := randomGray(image.Rect(0, 0, 8, 8), 77, 77, 1)
+	for _, p := range NormalizeGray(flat, normalizeMean, normalizeStd*normalizeStd).Pix {
+		if p != normalizeMean {
+			t.Fatalf("a flat image becomes %d, want the mean", p)
+		}
+	}
+}
+
+func TestEqualizeGray(t *testing.T) {
+	img := randomGray(image.Rect(0, 0, 64, 64), 90, 140, 2)
+	out := EqualizeGray(img)
+	checkMonotone(t, "equalize", img, out)
+	low, high := 255, 0
+	for _, p := range out.Pix {
+		low, high = int(math.Min(float64(low), float64(p))), int(math.Max(float64(high), float64(p)))
+	}
+	if low != 0 || high != 255 {
+		t.Errorf("levels in [%d, %d], want [0, 255]", low, high)
+	}
+	// the share of the pixels at or below each level grows linearly
+	var histogram [256]int
+	for _, p := range out.Pix {
+		histogram[p]++
+	}
+	cdf := 0
+	for v, c := range histogram {
+		cdf += c
+		if share := float64(cdf) / float64(len(out.Pix)); c > 0 && math.Abs(share-float64(v)/255) > 0.05 {
+			t.Errorf("%.3f of the pixels at or below %d", share, v)
+		}
+	}
+
+	flat := randomGray(image.Rect(0, 0, 8, 8), 77, 77, 1)
+	for _, p := range EqualizeGray(flat).Pix {
+		if p != 77 {
+			t.Fatalf("a flat image becomes %d", p)
+		}
+	}
+}
+
+func TestCLAHEClipLimit(t *testing.T) {
+	// every level once per row, then a spike: half of the pixels at 100
+	img := image.NewGray(image.Rect(0, 0, 512, 32))
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 512; x++ {
+			v := 100
+			if x < 256 {
+				v = x
+			}
+			img.Pix[y*img.Stride+x] = uint8(v)
+		}
+	}
+	// a single tile is a global equalization with a clipped histogram, the
+	// mapping rises by at most clip times the average of 255/256 per level
+	for _, clip := range []float64{1, 2, 4} {
+		out := CLAHE(img, 1, clip)
+		checkMonotone(t, "clahe", img, out)
+		for v := 1; v < 256; v++ {
+			if step := float64(out.Pix[v]) - float64(out.Pix[v-1]); step > clip+2 {
+				t.Errorf("clip %g: level %d rises by %g", clip, v, step)
+			}
+		}
+	}
+	if step := int(EqualizeGray(img).Pix[100]) - int(EqualizeGray(img).Pix[99]); step < 100 {
+		t.Errorf("without a clip limit the spike rises by %d only", step)
+	}
+}
+
+func TestCLAHETiles(t *testing.T) {
+	// a dark half and a bright half, both of a low contrast
+	r := image.Rect(3, 7, 3+64, 7+64)
+	img := randomGray(r, 10, 25, 3)
+	bright := randomGray(r, 200, 215, 4)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X + 32; x < r.Max.X; x++ {
+			img.SetGray(x, y, bright.GrayAt(x, y))
+		}
+	}
+	out := CLAHE(img, 2, 4)
+	if out.Rect != r {
+		t.Fatalf("bounds %v, want %v", out.Rect, r)
+	}
+	for _, half := range []image.Rectangle{image.Rect(3, 7, 3+24, 7+64), image.Rect(3+40, 7, 3+64, 7+64)} {
+		low, high := 255, 0
+		for y := half.Min.Y; y < half.Max.Y; y++ {
+			for x := half.Min.X; x < half.Max.X; x++ {
+				p := int(out.GrayAt(x, y).Y)
+				low, high = int(math.Min(float64(low), float64(p))), int(math.Max(float64(high), float64(p)))
+			}
+		}
+		// 16 levels spread at least 4 times, as far as the clip limit allows
+		if high-low < 60 {
+			t.Errorf("%v: levels in [%d, %d], the contrast is not stretched locally", half, low, high)
+		}
+	}
+}
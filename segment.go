@@ -0,0 +1,272 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// The segmentation of the Sobel extractors keeps the pixels of the print
+// itself, the foreground, out of the white borders of the scan and the blank
+// regions left by obliteration or z-cut. The image is cut into blocks of
+// segmentBlock x segmentBlock pixels, and a block is foreground when:
+//
+//   - variance: the standard deviation of its gray levels is at least
+//     segmentThreshold times the one of the whole image, ridges alternate with
+//     valleys while the background is flat
+//   - coherence: its gradients run in one direction with a coherence of at
+//     least segmentThreshold, in [0, 1], which also rejects noisy background
+//
+// A block then takes the value of the majority of its 3x3 neighbourhood, to
+// drop isolated blocks and fill single block gaps.
+var segmentMethods = []string{"none", "variance", "coherence"}
+
+const defaultSegmentBlock = 8
+
+var defaultSegmentThresholds = map[string]float64{
+	"variance":  0.3,
+	"coherence": 0.5,
+}
+
+// segmentation is the `segment` parameter, with `segmentBlock` and
+// `segmentThreshold`. None is not recorded, as in the models of older
+// versions.
+type segmentation struct {
+	method    string
+	block     int
+	threshold float64
+}
+
+func segmentParam(params map[string]string) (*segmentation, error) {
+	s := &segmentation{method: "none", block: defaultSegmentBlock}
+	if v, ok := params["segment"]; ok {
+		s.method = v
+	}
+	found := false
+	for _, m := range segmentMethods {
+		found = found || m == s.method
+	}
+	if !found {
+		return nil, fmt.Errorf("parameter segment must be one of %s, got %q", strings.Join(segmentMethods, ", "), s.method)
+	}
+	if s.method == "none" {
+		for _, k := range []string{"segmentBlock", "segmentThreshold"} {
+			if _, ok := params[k]; ok {
+				return nil, fmt.Errorf("parameter %s needs a segment method", k)
+			}
+		}
+		return s, nil
+	}
+
+	var err error
+	if s.block, err = intParam(params, "segmentBlock", defaultSegmentBlock); err != nil {
+		return nil, err
+	}
+	if s.block < 2 || s.block > 64 {
+		return nil, fmt.Errorf("parameter segmentBlock must be within [2, 64], got %d", s.block)
+	}
+	if s.threshold, err = floatParam(params, "segmentThreshold", defaultSegmentThresholds[s.method]); err != nil {
+		return nil, err
+	}
+	if s.threshold < 0 || s.method == "coherence" && s.threshold > 1 {
+		return nil, fmt.Errorf("parameter segmentThreshold out of range for %s, got %g", s.method, s.threshold)
+	}
+	return s, nil
+}
+
+func (s *segmentation) addParams(params map[string]string) map[string]string {
+	if s.method == "none" {
+		return params
+	}
+	params["segment"] = s.method
+	params["segmentBlock"] = strconv.Itoa(s.block)
+	params["segmentThreshold"] = strconv.FormatFloat(s.threshold, 'g', -1, 64)
+	return params
+}
+
+// apply returns the foreground mask of img, nil without segmentation.
+func (s *segmentation) apply(img *image.Gray) *image.Gray {
+	if s.method == "none" {
+		return nil
+	}
+	return SegmentFingerprint(img, s.method, s.block, s.threshold)
+}
+
+// SegmentFingerprint returns the foreground mask of the print, 255 on the
+// print and 0 on the background, with the bounds of img. It is an image so
+// that saveImageFile can write it.
+func SegmentFingerprint(img *image.Gray, method string, block int, threshold float64) *image.Gray {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	mask := image.NewGray(img.Rect)
+	if w == 0 || h == 0 {
+		return mask
+	}
+	bw, bh := (w+block-1)/block, (h+block-1)/block
+
+	var score []float64
+	switch method {
+	case "variance":
+		score = blockDeviations(img, block)
+		var sum, ssq, n float64
+		grayPixels(img, func(p *uint8) {
+			sum += float64(*p)
+			ssq += float64(*p) * float64(*p)
+			n++
+		})
+		m := sum / n
+		threshold *= math.Sqrt(math.Max(ssq/n-m*m, 0))
+	case "coherence":
+		score = EstimateOrientation(img, block, 0).Coherence
+	default:
+		panic("unknown segmentation method " + method)
+	}
+
+	foreground := make([]bool, bw*bh)
+	for i, v := range score {
+		foreground[i] = v > 0 && v >= threshold
+	}
+	foreground = majorityBlocks(foreground, bw, bh)
+
+	for y := 0; y < h; y++ {
+		row := mask.Pix[mask.PixOffset(img.Rect.Min.X, img.Rect.Min.Y+y):]
+		for x := 0; x < w; x++ {
+			if foreground[(y/block)*bw+x/block] {
+				row[x] = 255
+			}
+		}
+	}
+	return mask
+}
+
+// blockDeviations returns the standard deviation of the gray levels of every
+// block, row by row.
+func blockDeviations(img *image.Gray, block int) []float64 {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	bw, bh := (w+block-1)/block, (h+block-1)/block
+	sum, ssq, n := make([]float64, bw*bh), make([]float64, bw*bh), make([]float64, bw*bh)
+	for y := 0; y < h; y++ {
+		row := img.Pix[img.PixOffset(img.Rect.Min.X, img.Rect.Min.Y+y):][:w]
+		for x, p := range row {
+			i := (y/block)*bw + x/block
+			sum[i] += float64(p)
+			ssq[i] += float64(p) * float64(p)
+			n[i]++
+		}
+	}
+	deviations := make([]float64, bw*bh)
+	for i := range deviations {
+		m := sum[i] / n[i]
+		deviations[i] = math.Sqrt(math.Max(ssq[i]/n[i]-m*m, 0))
+	}
+	return deviations
+}
+
+var (
+	gradientX = Kernel{Width: 3, Height: 3, Values: []float64{-1, 0, 1, -2, 0, 2, -1, 0, 1}}
+	gradientY = Kernel{Width: 3, Height: 3, Values: []float64{-1, -2, -1, 0, 0, 0, 1, 2, 1}}
+)
+
+// blockGradients sums the products of the Sobel gradients of the pixels of
+// every block, row by row: Gx², Gy² and Gx·Gy.
+func blockGradients(img *image.Gray, block int) (gxx, gyy, gxy []float64) {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	bw, bh := (w+block-1)/block, (h+block-1)/block
+	gx, gy := Convolve(img, gradientX, BorderReplicate), Convolve(img, gradientY, BorderReplicate)
+	gxx, gyy, gxy = make([]float64, bw*bh), make([]float64, bw*bh), make([]float64, bw*bh)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			i := (y/block)*bw + x/block
+			dx, dy := float64(gx.Pix[y*gx.Stride+x]), float64(gy.Pix[y*gy.Stride+x])
+			gxx[i] += dx * dx
+			gyy[i] += dy * dy
+			gxy[i] += dx * dy
+		}
+	}
+	return gxx, gyy, gxy
+}
+
+// majorityBlocks sets every block to the value of the majority of its 3x3
+// neighbourhood within the image, itself included; a tie keeps its value.
+func majorityBlocks(blocks []bool, bw, bh int) []bool {
+	out := make([]bool, len(blocks))
+	for by := 0; by < bh; by++ {
+		for bx := 0; bx < bw; bx++ {
+			set, n := 0, 0
+			for y := by - 1; y <= by+1; y++ {
+				for x := bx - 1; x <= bx+1; x++ {
+					if x < 0 || y < 0 || x >= bw || y >= bh {
+						continue
+					}
+					n++
+					if blocks[y*bw+x] {
+						set++
+					}
+				}
+			}
+			i := by*bw + bx
+			out[i] = 2*set > n || 2*set == n && blocks[i]
+		}
+	}
+	return out
+}
+
+// erodeMask returns the foreground of mask which is more than r pixels away
+// from its background, found with an integral image of the background. The
+// pixels beyond the image are not background.
+func erodeMask(mask *image.Gray, r int) *image.Gray {
+	w, h := mask.Rect.Dx(), mask.Rect.Dy()
+	background := make([]int, (w+1)*(h+1))
+	for y := 0; y < h; y++ {
+		row := mask.Pix[mask.PixOffset(mask.Rect.Min.X, mask.Rect.Min.Y+y):][:w]
+		n := 0
+		for x, p := range row {
+			if p == 0 {
+				n++
+			}
+			background[(y+1)*(w+1)+x+1] = background[y*(w+1)+x+1] + n
+		}
+	}
+	clamp := func(v, n int) int {
+		if v < 0 {
+			return 0
+		} else if v > n {
+			return n
+		}
+		return v
+	}
+
+	eroded := image.NewGray(mask.Rect)
+	for y := 0; y < h; y++ {
+		y0, y1 := clamp(y-r, h), clamp(y+r+1, h)
+		row := eroded.Pix[eroded.PixOffset(mask.Rect.Min.X, mask.Rect.Min.Y+y):]
+		for x := 0; x < w; x++ {
+			x0, x1 := clamp(x-r, w), clamp(x+r+1, w)
+			n := background[y1*(w+1)+x1] - background[y0*(w+1)+x1] - background[y1*(w+1)+x0] + background[y0*(w+1)+x0]
+			if n == 0 {
+				row[x] = 255
+			}
+		}
+	}
+	return eroded
+}
+
+// maskedPixels returns the pixels of img on the foreground of mask, row by
+// row; all of them without a mask.
+func maskedPixels(img, mask *image.Gray) []uint8 {
+	if mask == nil {
+		return img.Pix
+	}
+	pixels := []uint8{}
+	for y := img.Rect.Min.Y; y < img.Rect.Max.Y; y++ {
+		row := img.Pix[img.PixOffset(img.Rect.Min.X, y):][:img.Rect.Dx()]
+		in := mask.Pix[mask.PixOffset(img.Rect.Min.X, y):]
+		for x, p := range row {
+			if in[x] != 0 {
+				pixels = append(pixels, p)
+			}
+		}
+	}
+	return pixels
+}
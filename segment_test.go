@@ -0,0 +1,37 @@
+package main
+
+import (
+	"image"
+	"testing"
+)
+
+func TestErodeMask(t *testing.T) {
+	mask := drawSkeleton( // '#' is background here
+		"##########",
+		"##......##",
+		"#........#",
+		"#........#",
+		"#........#",
+		"##########",
+	)
+	want := drawSkeleton(
+		"##########",
+		"##########",
+		"###....###",
+		"##......##",
+		"##########",
+		"##########",
+	)
+	if got := erodeMask(mask, 1); string(got.Pix) != string(want.Pix) {
+		t.Errorf("eroded by 1:\n%v\nwant\n%v", got.Pix, want.Pix)
+	}
+
+	// the edge of the image is not background
+	full := image.NewGray(image.Rect(0, 0, 4, 3))
+	for i := range full.Pix {
+		full.Pix[i] = 255
+	}
+	if got := erodeMask(full, 2); string(got.Pix) != string(full.Pix) {
+		t.Errorf("full mask eroded: %v", got.Pix)
+	}
+}
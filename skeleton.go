@@ -0,0 +1,228 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+var (
+	binarizeWindow    = 15  // side of the window of the adaptive threshold, about one ridge period and a half
+	binarizeK         = 0.2 // how far below the local mean the threshold goes where the contrast is low
+	skeletonHoleArea  = 8   // white regions of at most this many pixels inside a ridge are pores
+	skeletonSpurLen   = 8   // branches shorter than this ending in the void are spurs
+	skeletonBridgeLen = 8   // ridges shorter than this joining two bifurcations are bridges
+)
+
+// SkeletonStats counts what the cleanup of a skeleton changed.
+type SkeletonStats struct {
+	Holes, Spurs, Bridges int
+}
+
+// Skeleton turns a gray print into its one pixel wide ridges, black on
+// white: adaptive binarization -> holes filled -> Zhang-Suen thinning ->
+// spurs and bridges removed.
+func Skeleton(img *image.Gray) (*image.Gray, SkeletonStats) {
+	var stats SkeletonStats
+	bin := binarizeAdaptive(img, binarizeWindow, binarizeK)
+	stats.Holes = fillHoles(bin, skeletonHoleArea)
+	skeleton := thin(bin)
+	stats.Spurs = removeSpurs(skeleton, skeletonSpurLen)
+	stats.Bridges = removeBridges(skeleton, skeletonBridgeLen)
+	return skeleton, stats
+}
+
+// binarizeAdaptive turns the print into black ridges (0) on white (255) with
+// the threshold of Sauvola and Pietikäinen (2000), computed on the window
+// of window x window pixels around every pixel: mean * (1 + k (std/128 - 1)).
+// Unlike a single threshold for the whole print, as Otsu's, it follows the
+// changes of pressure across the print, and stays below the mean on a flat
+// background so that its noise does not turn into ridges.
+func binarizeAdaptive(img *image.Gray, window int, k float64) *image.Gray {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	bin := image.NewGray(img.Rect)
+
+	// integral images of the gray levels and of their squares
+	sum := make([]float64, (w+1)*(h+1))
+	ssq := make([]float64, (w+1)*(h+1))
+	for y := 0; y < h; y++ {
+		var rowSum, rowSsq float64
+		for x := 0; x < w; x++ {
+			v := float64(img.Pix[img.PixOffset(img.Rect.Min.X+x, img.Rect.Min.Y+y)])
+			rowSum += v
+			rowSsq += v * v
+			sum[(y+1)*(w+1)+x+1] = sum[y*(w+1)+x+1] + rowSum
+			ssq[(y+1)*(w+1)+x+1] = ssq[y*(w+1)+x+1] + rowSsq
+		}
+	}
+	area := func(table []float64, x0, y0, x1, y1 int) float64 {
+		return table[y1*(w+1)+x1] - table[y0*(w+1)+x1] - table[y1*(w+1)+x0] + table[y0*(w+1)+x0]
+	}
+
+	r := window / 2
+	for y := 0; y < h; y++ {
+		y0, y1 := y-r, y+r+1
+		if y0 < 0 {
+			y0 = 0
+		}
+		if y1 > h {
+			y1 = h
+		}
+		for x := 0; x < w; x++ {
+			x0, x1 := x-r, x+r+1
+			if x0 < 0 {
+				x0 = 0
+			}
+			if x1 > w {
+				x1 = w
+			}
+			n := float64((x1 - x0) * (y1 - y0))
+			mean := area(sum, x0, y0, x1, y1) / n
+			std := math.Sqrt(math.Max(area(ssq, x0, y0, x1, y1)/n-mean*mean, 0))
+			threshold := mean * (1 + k*(std/128-1))
+			v := img.Pix[img.PixOffset(img.Rect.Min.X+x, img.Rect.Min.Y+y)]
+			if float64(v) > threshold {
+				bin.Pix[y*bin.Stride+x] = 255
+			}
+		}
+	}
+	return bin
+}
+
+// fillHoles turns into ridge the white regions of at most maxArea pixels which
+// do not touch the border of the binary image, the pores and the gaps which
+// would leave loops in the skeleton. It returns the number of regions filled.
+func fillHoles(bin *image.Gray, maxArea int) int {
+	w, h := bin.Rect.Dx(), bin.Rect.Dy()
+	seen := make([]bool, w*h)
+	filled := 0
+	region := []int{}
+	for start := range seen {
+		if seen[start] || bin.Pix[(start/w)*bin.Stride+start%w] == 0 {
+			continue
+		}
+		// the 4-connected white region of start
+		region = append(region[:0], start)
+		seen[start] = true
+		border := false
+		for i := 0; i < len(region); i++ {
+			x, y := region[i]%w, region[i]/w
+			border = border || x == 0 || y == 0 || x == w-1 || y == h-1
+			for k := 0; k < 8; k += 2 {
+				nx, ny := x+nbDx[k], y+nbDy[k]
+				if nx < 0 || ny < 0 || nx >= w || ny >= h {
+					continue
+				}
+				if j := ny*w + nx; !seen[j] && bin.Pix[ny*bin.Stride+nx] != 0 {
+					seen[j] = true
+					region = append(region, j)
+				}
+			}
+		}
+		if border || len(region) > maxArea {
+			continue
+		}
+		for _, i := range region {
+			bin.Pix[(i/w)*bin.Stride+i%w] = 0
+		}
+		filled++
+	}
+	return filled
+}
+
+func erase(skeleton *image.Gray, path []image.Point) {
+	for _, p := range path {
+		skeleton.Pix[p.Y*skeleton.Stride+p.X] = 255
+	}
+}
+
+// removeSpurs erases the branches of less than maxLen pixels from a ridge
+// ending to a junction, only the shortest one of a junction since the end of
+// the ridge it sits on may be as short, and the isolated ridges shorter than
+// maxLen. It returns the number of branches erased.
+func removeSpurs(skeleton *image.Gray, maxLen int) int {
+	w, h := skeleton.Rect.Dx(), skeleton.Rect.Dy()
+	removed := 0
+	spurs := map[image.Point][]image.Point{} // by junction
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if !isRidge(skeleton, x, y) {
+				continue
+			}
+			origin := image.Pt(x, y)
+			switch crossingNumber(skeleton, x, y) {
+			case 0:
+				// a lone pixel
+				erase(skeleton, []image.Point{origin})
+				removed++
+			case 1:
+				starts := branchStarts(skeleton, x, y)
+				if len(starts) != 1 {
+					continue
+				}
+				path, junction, end := traceRidge(skeleton, origin, starts[0], nil, maxLen)
+				if len(path)+1 >= maxLen {
+					continue
+				}
+				path = append(path, origin)
+				if !junction {
+					erase(skeleton, path)
+					removed++
+				} else if spur, ok := spurs[end]; !ok || len(path) < len(spur) {
+					spurs[end] = path
+				}
+			}
+		}
+	}
+	for _, spur := range spurs {
+		erase(skeleton, spur)
+		removed++
+	}
+	return removed
+}
+
+// removeBridges erases the ridges of less than maxLen pixels joining two
+// bifurcations, which join neighbouring ridges across their valley. Of a
+// loop, only one side goes: both ends then no longer are bifurcations. It
+// returns the number of ridges erased.
+func removeBridges(skeleton *image.Gray, maxLen int) int {
+	w, h := skeleton.Rect.Dx(), skeleton.Rect.Dy()
+	removed := 0
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if !isRidge(skeleton, x, y) || crossingNumber(skeleton, x, y) < 3 {
+				continue
+			}
+			origin := image.Pt(x, y)
+			starts := branchStarts(skeleton, x, y)
+			for _, start := range starts {
+				if !isRidge(skeleton, start.X, start.Y) || crossingNumber(skeleton, x, y) < 3 {
+					continue
+				}
+				path, junction, _ := traceRidge(skeleton, origin, start, starts, maxLen)
+				if junction && len(path) > 0 && len(path) < maxLen {
+					erase(skeleton, path)
+					removed++
+				}
+			}
+		}
+	}
+	return removed
+}
+
+// SkeletonOverlay draws the skeleton in red over the gray print.
+func SkeletonOverlay(img, skeleton *image.Gray) *image.RGBA {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	out := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.RGBA{255, 0, 0, 255}
+			if !isRidge(skeleton, x, y) {
+				g := img.Pix[img.PixOffset(img.Rect.Min.X+x, img.Rect.Min.Y+y)]
+				c = color.RGBA{g, g, g, 255}
+			}
+			out.SetRGBA(x, y, c)
+		}
+	}
+	return out
+}
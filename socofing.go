@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// SampleInfo is what a SOCOFing file name tells about the print:
+//
+//	<subject>__<gender>_<hand>_<finger>_finger[_<alteration>].BMP
+//
+// e.g. `64__M_Right_index_finger.BMP` or `64__M_Right_index_finger_Zcut.BMP`.
+// Alteration is empty for the Real prints.
+type SampleInfo struct {
+	SubjectID  string
+	Gender     string
+	Hand       string
+	Finger     string
+	Alteration string
+}
+
+var (
+	sampleGenders     = []string{"M", "F"}
+	sampleHands       = []string{"Left", "Right"}
+	sampleFingers     = []string{"thumb", "index", "middle", "ring", "little"}
+	sampleAlterations = []string{"CR", "Obl", "Zcut"}
+	sampleFields      = []string{"subject", "gender", "hand", "finger", "alteration"}
+)
+
+func oneOf(value string, allowed []string) bool {
+	for _, a := range allowed {
+		if value == a {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseSampleName parses a SOCOFing file name, with or without its extension
+// and directory.
+func ParseSampleName(name string) (SampleInfo, error) {
+	base := filepath.Base(name)
+	base = strings.TrimSuffix(base, filepath.Ext(base))
+
+	fail := func(format string, args ...interface{}) (SampleInfo, error) {
+		return SampleInfo{}, fmt.Errorf("invalid SOCOFing name %q: %s", name, fmt.Sprintf(format, args...))
+	}
+
+	parts := strings.SplitN(base, "__", 2)
+	if len(parts) != 2 {
+		return fail("expected <subject>__<gender>_<hand>_<finger>_finger[_<alteration>]")
+	}
+	info := SampleInfo{SubjectID: parts[0]}
+	if info.SubjectID == "" || strings.Trim(info.SubjectID, "0123456789") != "" {
+		return fail("subject %q is not a number", info.SubjectID)
+	}
+
+	fields := strings.Split(parts[1], "_")
+	if len(fields) != 4 && len(fields) != 5 {
+		return fail("expected 4 or 5 fields after the subject, got %d", len(fields))
+	}
+	info.Gender, info.Hand, info.Finger = fields[0], fields[1], fields[2]
+	if !oneOf(info.Gender, sampleGenders) {
+		return fail("gender %q is not one of %s", info.Gender, strings.Join(sampleGenders, ", "))
+	}
+	if !oneOf(info.Hand, sampleHands) {
+		return fail("hand %q is not one of %s", info.Hand, strings.Join(sampleHands, ", "))
+	}
+	if !oneOf(info.Finger, sampleFingers) {
+		return fail("finger %q is not one of %s", info.Finger, strings.Join(sampleFingers, ", "))
+	}
+	if fields[3] != "finger" {
+		return fail("expected `finger` after the finger name, got %q", fields[3])
+	}
+	if len(fields) == 5 {
+		info.Alteration = fields[4]
+		if !oneOf(info.Alteration, sampleAlterations) {
+			return fail("alteration %q is not one of %s", info.Alteration, strings.Join(sampleAlterations, ", "))
+		}
+	}
+	return info, nil
+}
+
+// Field returns the value of one of `subject`, `gender`, `hand`, `finger` or
+// `alteration`; unaltered prints have the alteration `none`.
+func (s SampleInfo) Field(field string) (string, error) {
+	switch field {
+	case "subject":
+		return s.SubjectID, nil
+	case "gender":
+		return s.Gender, nil
+	case "hand":
+		return s.Hand, nil
+	case "finger":
+		return s.Finger, nil
+	case "alteration":
+		if s.Alteration == "" {
+			return "none", nil
+		}
+		return s.Alteration, nil
+	}
+	return "", fmt.Errorf("unknown field %q (available: %s)", field, strings.Join(sampleFields, ", "))
+}
+
+// A SampleFilter keeps the samples whose fields have the given values, it is
+// filled from repeated `-filter field=value` flags.
+type SampleFilter map[string]string
+
+func (f SampleFilter) String() string {
+	return formatParams(f)
+}
+
+func (f SampleFilter) Set(pair string) error {
+	k, v, err := parseParam(pair)
+	if err != nil {
+		return err
+	}
+	if _, err := (SampleInfo{}).Field(k); err != nil {
+		return err
+	}
+	f[k] = v
+	return nil
+}
+
+func (f SampleFilter) Match(s SampleInfo) bool {
+	for field, value := range f {
+		if v, _ := s.Field(field); v != value {
+			return false
+		}
+	}
+	return true
+}
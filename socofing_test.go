@@ -0,0 +1,79 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseSampleName(t *testing.T) {
+	tests := []struct {
+		name string
+		want SampleInfo
+	}{
+		{"64__M_Right_index_finger.BMP", SampleInfo{"64", "M", "Right", "index", ""}},
+		{"1__F_Left_little_finger.BMP", SampleInfo{"1", "F", "Left", "little", ""}},
+		{"64__M_Right_index_finger_CR.BMP", SampleInfo{"64", "M", "Right", "index", "CR"}},
+		{"600__F_Left_thumb_finger_Obl.BMP", SampleInfo{"600", "F", "Left", "thumb", "Obl"}},
+		{"Altered-Hard/17__M_Right_ring_finger_Zcut.BMP", SampleInfo{"17", "M", "Right", "ring", "Zcut"}},
+		{"12__M_Left_middle_finger", SampleInfo{"12", "M", "Left", "middle", ""}}, // a test_data label
+		{"3__F_Right_thumb_finger.png", SampleInfo{"3", "F", "Right", "thumb", ""}},
+	}
+	for _, tt := range tests {
+		got, err := ParseSampleName(tt.name)
+		if err != nil || got != tt.want {
+			t.Errorf("%s: %+v, %v; want %+v", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseSampleNameInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		err  string
+	}{
+		{"64_M_Right_index_finger.BMP", "expected <subject>__"},
+		{"__M_Right_index_finger.BMP", `subject "" is not a number`},
+		{"6a__M_Right_index_finger.BMP", `subject "6a" is not a number`},
+		{"64__M_Right_index.BMP", "expected 4 or 5 fields after the subject, got 3"},
+		{"64__M_Right_index_finger_CR_2.BMP", "expected 4 or 5 fields after the subject, got 6"},
+		{"64__X_Right_index_finger.BMP", `gender "X" is not one of M, F`},
+		{"64__M_Up_index_finger.BMP", `hand "Up" is not one of Left, Right`},
+		{"64__M_Right_pinky_finger.BMP", `finger "pinky" is not one of`},
+		{"64__M_Right_index_toe.BMP", "expected `finger` after the finger name"},
+		{"64__M_Right_index_finger_Blur.BMP", `alteration "Blur" is not one of CR, Obl, Zcut`},
+		{"64__m_right_index_finger.BMP", `gender "m"`},
+		{"README.md", "expected <subject>__"},
+	}
+	for _, tt := range tests {
+		_, err := ParseSampleName(tt.name)
+		if err == nil || !strings.Contains(err.Error(), tt.err) || !strings.Contains(err.Error(), tt.name) {
+			t.Errorf("%s: error %v, want one naming the file with %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestSampleFilter(t *testing.T) {
+	info, err := ParseSampleName("64__M_Right_index_finger_Zcut.BMP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unaltered, err := ParseSampleName("64__M_Right_index_finger.BMP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	filter := SampleFilter{}
+	for _, pair := range []string{"subject=64", "hand=Right", "alteration=Zcut"} {
+		if err := filter.Set(pair); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !filter.Match(info) || filter.Match(unaltered) {
+		t.Errorf("%v matches %v: %v, %v: %v", filter, info, filter.Match(info), unaltered, filter.Match(unaltered))
+	}
+	if err := (SampleFilter{}).Set("alteration=none"); err != nil || !(SampleFilter{"alteration": "none"}).Match(unaltered) {
+		t.Errorf("alteration=none does not match an unaltered print: %v", err)
+	}
+	if err := filter.Set("colour=red"); err == nil {
+		t.Error("unknown field accepted")
+	}
+}
@@ -0,0 +1,1506 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"math"
+)
+
+// WSQ, Wavelet Scalar Quantization, is the FBI compression of 500 ppi
+// fingerprints (IAFIS-IC-0110). The codec follows the structure of the NIST
+// reference implementation (NBIS): a 5 level 2D wavelet decomposition with
+// the 9/7 biorthogonal filters into 64 subbands, of which the first 60 are
+// scalar quantized, and Huffman coded in 3 blocks.
+//
+// A stream is a sequence of markers:
+//
+//	SOI, tables (DTT, DQT, DHT, COM), SOF, then for every block:
+//	tables, SOB, entropy coded data; and EOI.
+const (
+	wsqSOI = 0xffa0
+	wsqEOI = 0xffa1
+	wsqSOF = 0xffa2
+	wsqSOB = 0xffa3
+	wsqDTT = 0xffa4
+	wsqDQT = 0xffa5
+	wsqDHT = 0xffa6
+	wsqDRT = 0xffa7
+	wsqCOM = 0xffa8
+
+	wsqMaxSubbands     = 64
+	wsqNumSubbands     = 60 // the last 4 subbands are never coded
+	wsqStrtSubband2    = 19 // first subband of the second block
+	wsqStrtSubband3    = 52 // first subband of the third block
+	wsqStrtSizeRegion2 = 4  // first subband of 1/256 of the image
+	wsqStrtSizeRegion3 = 51 // first subband of 1/16 of the image
+
+	wsqMaxHuffBits    = 16
+	wsqMaxHuffCoeff   = 74  // coefficients within [-73, 74] have their own code
+	wsqMaxHuffZeroRun = 100 // so do runs of up to 100 zeros
+	wsqBinCenter      = 0.44
+	wsqMinSubbandLen  = 5
+)
+
+// wsqBitrate is the default bit rate of encodeWSQ, in bits per pixel, about
+// 15:1 compression; the reference encoder uses 0.75 or 2.25.
+var wsqBitrate = 0.75
+
+// The analysis filters of the encoder. The decoder uses the synthesis filters
+// derived from the transform table of the stream.
+var (
+	wsqLoFilter = []float32{
+		0.03782845550699535, -0.02384946501937986, -0.11062440441842342, 0.37740285561265380,
+		0.85269867900940344,
+		0.37740285561265380, -0.11062440441842342, -0.02384946501937986, 0.03782845550699535,
+	}
+	wsqHiFilter = []float32{
+		0.06453888262893845, -0.04068941760955844, -0.41809227322221221,
+		0.78848561640566439,
+		-0.41809227322221221, -0.04068941760955844, 0.06453888262893845,
+	}
+)
+
+func init() {
+	image.RegisterFormat("wsq", "\xff\xa0", decodeWSQ, decodeWSQConfig)
+}
+
+// wsqNode locates a region of the image: a node of the wavelet decomposition
+// tree, or a subband of the quantization tree.
+type wsqNode struct {
+	x, y, lenx, leny int
+	invRow, invCol   bool // spectral inversion of the rows, of the columns
+}
+
+// wsqTrees computes the decomposition tree (20 nodes) and the quantization
+// tree (64 subbands) of an image.
+func wsqTrees(width, height int) (w [20]wsqNode, q [wsqMaxSubbands]wsqNode, err error) {
+	for _, n := range []int{2, 4, 7, 9, 11, 13, 16, 18} {
+		w[n].invRow = true
+	}
+	for _, n := range []int{3, 5, 8, 9, 12, 13, 17, 18} {
+		w[n].invCol = true
+	}
+
+	wsqTree4(w[:], 0, 1, width, height, 0, 0, true)
+	lenx, lenx2 := w[1].lenx/2, w[1].lenx/2
+	if w[1].lenx%2 != 0 {
+		lenx = (w[1].lenx + 1) / 2
+		lenx2 = lenx - 1
+	}
+	leny, leny2 := w[1].leny/2, w[1].leny/2
+	if w[1].leny%2 != 0 {
+		leny = (w[1].leny + 1) / 2
+		leny2 = leny - 1
+	}
+	wsqTree4(w[:], 4, 6, lenx2, leny, lenx, 0, false)
+	wsqTree4(w[:], 5, 10, lenx, leny2, 0, leny, false)
+	wsqTree4(w[:], 14, 15, lenx, leny, 0, 0, false)
+	w[19].lenx = (w[15].lenx + 1) / 2
+	w[19].leny = (w[15].leny + 1) / 2
+
+	for i, n := range w {
+		if n.lenx < wsqMinSubbandLen || n.leny < wsqMinSubbandLen {
+			return w, q, fmt.Errorf("wsq: %dx%d image is too small, node %d is %dx%d", width, height, i, n.lenx, n.leny)
+		}
+	}
+
+	wsqQTree16(q[:], 3, w[14], false, false)
+	wsqQTree16(q[:], 19, w[4], false, true)
+	wsqQTree16(q[:], 48, w[0], false, false)
+	wsqQTree16(q[:], 35, w[5], true, false)
+	wsqQTree4(q[:], 0, w[19])
+	return w, q, nil
+}
+
+// wsqTree4 splits the node start1 into the 4 nodes from start2.
+func wsqTree4(w []wsqNode, start1, start2, lenx, leny, x, y int, stop bool) {
+	p1, p2 := start1, start2
+	w[p1].x, w[p1].y, w[p1].lenx, w[p1].leny = x, y, lenx, leny
+
+	w[p2].x, w[p2+2].x = x, x
+	w[p2].y, w[p2+1].y = y, y
+	if lenx%2 == 0 {
+		w[p2].lenx = lenx / 2
+		w[p2+1].lenx = w[p2].lenx
+	} else if p1 == 4 {
+		w[p2].lenx = (lenx - 1) / 2
+		w[p2+1].lenx = w[p2].lenx + 1
+	} else {
+		w[p2].lenx = (lenx + 1) / 2
+		w[p2+1].lenx = w[p2].lenx - 1
+	}
+	w[p2+1].x = w[p2].lenx + x
+	if !stop {
+		w[p2+3].lenx = w[p2+1].lenx
+		w[p2+3].x = w[p2+1].x
+	}
+	w[p2+2].lenx = w[p2].lenx
+
+	if leny%2 == 0 {
+		w[p2].leny = leny / 2
+		w[p2+2].leny = w[p2].leny
+	} else if p1 == 5 {
+		w[p2].leny = (leny - 1) / 2
+		w[p2+2].leny = w[p2].leny + 1
+	} else {
+		w[p2].leny = (leny + 1) / 2
+		w[p2+2].leny = w[p2].leny - 1
+	}
+	w[p2+2].y = w[p2].leny + y
+	if !stop {
+		w[p2+3].leny = w[p2+2].leny
+		w[p2+3].y = w[p2+2].y
+	}
+	w[p2+1].leny = w[p2].leny
+}
+
+// wsqQTree16 splits a node into 16 subbands from p.
+func wsqQTree16(q []wsqNode, p int, n wsqNode, rw, cl bool) {
+	x, y, lenx, leny := n.x, n.y, n.lenx, n.leny
+	tempx, temp2x := lenx/2, lenx/2
+	if lenx%2 != 0 {
+		if cl {
+			temp2x = (lenx + 1) / 2
+			tempx = temp2x - 1
+		} else {
+			tempx = (lenx + 1) / 2
+			temp2x = tempx - 1
+		}
+	}
+	tempy, temp2y := leny/2, leny/2
+	if leny%2 != 0 {
+		if rw {
+			temp2y = (leny + 1) / 2
+			tempy = temp2y - 1
+		} else {
+			tempy = (leny + 1) / 2
+			temp2y = tempy - 1
+		}
+	}
+
+	q[p].x, q[p+2].x = x, x
+	q[p].y, q[p+1].y = y, y
+	if tempx%2 == 0 {
+		q[p].lenx = tempx / 2
+		q[p+1].lenx, q[p+2].lenx, q[p+3].lenx = q[p].lenx, q[p].lenx, q[p].lenx
+	} else {
+		q[p].lenx = (tempx + 1) / 2
+		q[p+1].lenx = q[p].lenx - 1
+		q[p+2].lenx = q[p].lenx
+		q[p+3].lenx = q[p+1].lenx
+	}
+	q[p+1].x = x + q[p].lenx
+	q[p+3].x = q[p+1].x
+	if tempy%2 == 0 {
+		q[p].leny = tempy / 2
+		q[p+1].leny, q[p+2].leny, q[p+3].leny = q[p].leny, q[p].leny, q[p].leny
+	} else {
+		q[p].leny = (tempy + 1) / 2
+		q[p+1].leny = q[p].leny
+		q[p+2].leny = q[p].leny - 1
+		q[p+3].leny = q[p+2].leny
+	}
+	q[p+2].y = y + q[p].leny
+	q[p+3].y = q[p+2].y
+
+	q[p+4].x = x + tempx
+	q[p+6].x = q[p+4].x
+	q[p+4].y, q[p+5].y = y, y
+	q[p+6].y, q[p+7].y = q[p+2].y, q[p+2].y
+	q[p+4].leny, q[p+5].leny = q[p].leny, q[p].leny
+	q[p+6].leny, q[p+7].leny = q[p+2].leny, q[p+2].leny
+	if temp2x%2 == 0 {
+		q[p+4].lenx = temp2x / 2
+		q[p+5].lenx, q[p+6].lenx, q[p+7].lenx = q[p+4].lenx, q[p+4].lenx, q[p+4].lenx
+	} else {
+		q[p+5].lenx = (temp2x + 1) / 2
+		q[p+4].lenx = q[p+5].lenx - 1
+		q[p+6].lenx = q[p+4].lenx
+		q[p+7].lenx = q[p+5].lenx
+	}
+	q[p+5].x = q[p+4].x + q[p+4].lenx
+	q[p+7].x = q[p+5].x
+
+	q[p+8].x, q[p+10].x = x, x
+	q[p+9].x, q[p+11].x = q[p+1].x, q[p+1].x
+	q[p+8].y = y + tempy
+	q[p+9].y = q[p+8].y
+	q[p+8].lenx, q[p+10].lenx = q[p].lenx, q[p].lenx
+	q[p+9].lenx, q[p+11].lenx = q[p+1].lenx, q[p+1].lenx
+	if temp2y%2 == 0 {
+		q[p+8].leny = temp2y / 2
+		q[p+9].leny, q[p+10].leny, q[p+11].leny = q[p+8].leny, q[p+8].leny, q[p+8].leny
+	} else {
+		q[p+10].leny = (temp2y + 1) / 2
+		q[p+11].leny = q[p+10].leny
+		q[p+8].leny = q[p+10].leny - 1
+		q[p+9].leny = q[p+8].leny
+	}
+	q[p+10].y = q[p+8].y + q[p+8].leny
+	q[p+11].y = q[p+10].y
+
+	q[p+12].x, q[p+14].x = q[p+4].x, q[p+4].x
+	q[p+13].x, q[p+15].x = q[p+5].x, q[p+5].x
+	q[p+12].y, q[p+13].y = q[p+8].y, q[p+8].y
+	q[p+14].y, q[p+15].y = q[p+10].y, q[p+10].y
+	q[p+12].lenx, q[p+14].lenx = q[p+4].lenx, q[p+4].lenx
+	q[p+13].lenx, q[p+15].lenx = q[p+5].lenx, q[p+5].lenx
+	q[p+12].leny, q[p+13].leny = q[p+8].leny, q[p+8].leny
+	q[p+14].leny, q[p+15].leny = q[p+10].leny, q[p+10].leny
+}
+
+// wsqQTree4 splits a node into 4 subbands from p.
+func wsqQTree4(q []wsqNode, p int, n wsqNode) {
+	x, y, lenx, leny := n.x, n.y, n.lenx, n.leny
+	q[p].x, q[p+2].x = x, x
+	q[p].y, q[p+1].y = y, y
+	if lenx%2 == 0 {
+		q[p].lenx = lenx / 2
+		q[p+1].lenx, q[p+2].lenx, q[p+3].lenx = q[p].lenx, q[p].lenx, q[p].lenx
+	} else {
+		q[p].lenx = (lenx + 1) / 2
+		q[p+1].lenx = q[p].lenx - 1
+		q[p+2].lenx = q[p].lenx
+		q[p+3].lenx = q[p+1].lenx
+	}
+	q[p+1].x = x + q[p].lenx
+	q[p+3].x = q[p+1].x
+	if leny%2 == 0 {
+		q[p].leny = leny / 2
+		q[p+1].leny, q[p+2].leny, q[p+3].leny = q[p].leny, q[p].leny, q[p].leny
+	} else {
+		q[p].leny = (leny + 1) / 2
+		q[p+1].leny = q[p].leny
+		q[p+2].leny = q[p].leny - 1
+		q[p+3].leny = q[p+2].leny
+	}
+	q[p+2].y = y + q[p].leny
+	q[p+3].y = q[p+2].y
+}
+
+// wsqFilter convolves the line at[0..n) with f, starting at sample px and
+// walking in the direction step, reflected on the first and last samples.
+func wsqFilter(at func(int) float32, n, px, step int, f []float32) float32 {
+	sum := at(px) * f[0]
+	for i := 1; i < len(f); i++ {
+		if px == 0 {
+			step = 1
+		}
+		if px == n-1 {
+			step = -1
+		}
+		px += step
+		sum += at(px) * f[i]
+	}
+	return sum
+}
+
+// wsqGetLets splits len1 lines of len2 samples of src into their low pass
+// then high pass halves in dst, or the other way round when inverted.
+// Only odd length, symmetric, filters are supported.
+func wsqGetLets(dst, src []float32, len1, len2, pitch, stride int, hi, lo []float32, inv bool) {
+	llen, hlen := len2/2, len2/2
+	if len2%2 != 0 {
+		llen = (len2 + 1) / 2
+		hlen = llen - 1
+	}
+	loc := (len(lo) - 1) / 2
+	hoc := (len(hi)-1)/2 - 1
+
+	for rw := 0; rw < len1; rw++ {
+		base := rw * pitch
+		lopass, hipass := base, base+llen*stride
+		if inv {
+			hipass, lopass = base, base+hlen*stride
+		}
+		at := func(i int) float32 { return src[base+i*stride] }
+
+		lspx, lstep := loc, -1
+		hspx, hstep := hoc, -1
+		for pix := 0; pix < hlen; pix++ {
+			dst[lopass] = wsqFilter(at, len2, lspx, lstep, lo)
+			lopass += stride
+			dst[hipass] = wsqFilter(at, len2, hspx, hstep, hi)
+			hipass += stride
+			for i := 0; i < 2; i++ {
+				if lspx == 0 {
+					lstep = 1
+				}
+				lspx += lstep
+				if hspx == 0 {
+					hstep = 1
+				}
+				hspx += hstep
+			}
+		}
+		if len2%2 != 0 {
+			dst[lopass] = wsqFilter(at, len2, lspx, lstep, lo)
+		}
+	}
+}
+
+// wsqWalker walks the samples of a subband line for the synthesis filters,
+// reflecting on its ends; on an end flagged to repeat, the end sample is
+// used twice before turning back.
+type wsqWalker struct {
+	px, step                int
+	repeatLeft, repeatRight bool
+}
+
+// turn changes the direction on the ends of a line of n samples, the right
+// one only when n is above 0.
+func (w *wsqWalker) turn(n int) {
+	if w.px == 0 {
+		if w.repeatLeft {
+			w.step, w.repeatLeft = 0, false
+		} else {
+			w.step = 1
+		}
+	}
+	if w.px == n-1 {
+		if w.repeatRight {
+			w.step, w.repeatRight = 0, false
+		} else {
+			w.step = -1
+		}
+	}
+}
+
+// wsqJoinLets is the inverse of wsqGetLets: it merges the low and high pass
+// halves of src into len1 lines of len2 samples in dst.
+func wsqJoinLets(dst, src []float32, len1, len2, pitch, stride int, hi, lo []float32, inv bool) {
+	llen, hlen := len2/2, len2/2
+	odd := len2%2 != 0
+	if odd {
+		llen = (len2 + 1) / 2
+		hlen = llen - 1
+	}
+	lsz, hsz := len(lo), len(hi)
+	loc := (lsz - 1) / 4
+	hoc := (hsz+1)/4 - 1
+	lotap := ((lsz - 1) / 2) % 2
+	hotap := ((hsz + 1) / 2) % 2
+	// the high pass line repeats its left end, and the right end of the
+	// shorter of the two lines
+	olre, ohre := !odd, odd
+
+	for cl := 0; cl < len1; cl++ {
+		limg := cl * pitch
+		himg := limg
+		lopass, hipass := cl*pitch, cl*pitch+llen*stride
+		if inv {
+			hipass, lopass = cl*pitch, cl*pitch+hlen*stride
+		}
+
+		// every output sample sums one of two filter taps, from tap
+		lowTaps := func(w wsqWalker, tap int) float32 {
+			sum := src[lopass+w.px*stride] * lo[tap]
+			for i := tap + 2; i < lsz; i += 2 {
+				w.turn(llen)
+				w.px += w.step
+				sum += src[lopass+w.px*stride] * lo[i]
+			}
+			return sum
+		}
+		highTaps := func(w wsqWalker, tap int) float32 {
+			var sum float32
+			for i := tap; i < hsz; i += 2 {
+				w.turn(hlen)
+				sum += src[hipass+w.px*stride] * hi[i]
+				w.px += w.step
+			}
+			return sum
+		}
+
+		ls := wsqWalker{px: loc, step: -1, repeatRight: olre}
+		hs := wsqWalker{px: hoc, step: -1, repeatLeft: true, repeatRight: ohre}
+		lstap, hstap := lotap, hotap
+		for pix := 0; pix < hlen; pix++ {
+			for tap := lstap; tap >= 0; tap-- {
+				dst[limg] = lowTaps(ls, tap)
+				limg += stride
+			}
+			ls.turn(0)
+			ls.px += ls.step
+			lstap = 1
+
+			for tap := hstap; tap >= 0; tap-- {
+				dst[himg] += highTaps(hs, tap)
+				himg += stride
+			}
+			hs.turn(0)
+			hs.px += hs.step
+			hstap = 1
+		}
+
+		// the last samples of the line
+		lstap, hstap = 1+lotap, 1+hotap
+		if odd {
+			lstap, hstap = lotap, hotap
+		}
+		for tap := 1; tap >= lstap; tap-- {
+			dst[limg] = lowTaps(ls, tap)
+			limg += stride
+		}
+		for tap := 1; tap >= hstap; tap-- {
+			dst[himg] += highTaps(hs, tap)
+			himg += stride
+		}
+	}
+}
+
+// wsqDecompose transforms the normalised image in place into its subbands.
+func wsqDecompose(f []float32, width int, w [20]wsqNode, hi, lo []float32) {
+	tmp := make([]float32, len(f))
+	for _, n := range w {
+		off := n.y*width + n.x
+		wsqGetLets(tmp, f[off:], n.leny, n.lenx, width, 1, hi, lo, n.invRow)
+		wsqGetLets(f[off:], tmp, n.lenx, n.leny, 1, width, hi, lo, n.invCol)
+	}
+}
+
+// wsqReconstruct is the inverse of wsqDecompose, with synthesis filters.
+func wsqReconstruct(f []float32, width int, w [20]wsqNode, hi, lo []float32) {
+	tmp := make([]float32, len(f))
+	for i := len(w) - 1; i >= 0; i-- {
+		n := w[i]
+		off := n.y*width + n.x
+		wsqJoinLets(tmp, f[off:], n.lenx, n.leny, 1, width, hi, lo, n.invCol)
+		wsqJoinLets(f[off:], tmp, n.leny, n.lenx, width, 1, hi, lo, n.invRow)
+	}
+}
+
+// wsqSynthesis derives the synthesis filters from the centre and right half
+// of the analysis filters, as transmitted in the transform table: the high
+// pass one alternates the signs of the low pass analysis filter and the
+// other way round.
+func wsqSynthesis(loHalf, hiHalf []float32) (hi, lo []float32) {
+	expand := func(half []float32) []float32 {
+		a := len(half) - 1
+		f := make([]float32, 2*a+1)
+		for i, v := range half {
+			if i%2 != 0 {
+				v = -v
+			}
+			f[a+i], f[a-i] = v, v
+		}
+		return f
+	}
+	return expand(loHalf), expand(hiHalf)
+}
+
+// wsqQuant is the content of the quantization table.
+type wsqQuant struct {
+	binCenter float32
+	qbin      [wsqMaxSubbands]float32 // bin width, 0 when the subband is not coded
+	zbin      [wsqMaxSubbands]float32 // width of the bin of 0
+}
+
+// wsqVariances are the variances of the subbands, over their centre, or over
+// all of them when the image has little detail.
+func wsqVariances(f []float32, width int, q [wsqMaxSubbands]wsqNode) [wsqNumSubbands]float32 {
+	variance := func(x, y, lenx, leny int) float32 {
+		if lenx*leny < 2 {
+			return 0
+		}
+		var sum, ssq float32
+		for row := y; row < y+leny; row++ {
+			for _, v := range f[row*width+x : row*width+x+lenx] {
+				sum += v
+				ssq += v * v
+			}
+		}
+		n := float32(lenx * leny)
+		return (ssq - sum*sum/n) / (n - 1)
+	}
+
+	var vars [wsqNumSubbands]float32
+	var vsum float32
+	for i := range vars {
+		n := q[i]
+		skipx, skipy := n.lenx/8, 9*n.leny/32
+		vars[i] = variance(n.x+skipx, n.y+skipy, 3*n.lenx/4, 7*n.leny/16)
+		vsum += vars[i]
+	}
+	if vsum < 20000 {
+		for i := range vars {
+			n := q[i]
+			vars[i] = variance(n.x, n.y, n.lenx, n.leny)
+		}
+	}
+	return vars
+}
+
+// wsqBitAlloc chooses the bin widths reaching the bit rate, in bits per
+// pixel: subbands of too low a variance, or which would get a negative
+// rate, are not coded.
+func wsqBitAlloc(vars [wsqNumSubbands]float32, bitrate float64) wsqQuant {
+	weights := [wsqNumSubbands]float64{}
+	for i := range weights {
+		weights[i] = 1
+	}
+	copy(weights[wsqStrtSubband3:], []float64{1.32, 1.08, 1.42, 1.08, 1.32, 1.42, 1.08, 1.08})
+	area := func(i int) float64 {
+		switch {
+		case i < wsqStrtSizeRegion2:
+			return 1.0 / 1024
+		case i < wsqStrtSizeRegion3:
+			return 1.0 / 256
+		}
+		return 1.0 / 16
+	}
+
+	var sigma, initial [wsqNumSubbands]float64
+	active := []int{}
+	for i, v := range vars {
+		if v < 1.01 {
+			continue
+		}
+		sigma[i] = math.Sqrt(float64(v))
+		initial[i] = 1
+		if i >= wsqStrtSizeRegion2 {
+			initial[i] = 10 / (weights[i] * math.Log(float64(v)))
+		}
+		active = append(active, i)
+	}
+
+	var scale float64
+	for len(active) > 0 {
+		var s, p float64 = 0, 1
+		for _, i := range active {
+			s += area(i)
+			p *= math.Pow(sigma[i]/initial[i], area(i))
+		}
+		scale = (math.Pow(2, bitrate/s-1) / 2.5) / math.Pow(p, 1/s)
+		kept := active[:0:0]
+		for _, i := range active {
+			if initial[i]/scale < 5*sigma[i] {
+				kept = append(kept, i)
+			}
+		}
+		if len(kept) == len(active) {
+			break
+		}
+		active = kept
+	}
+
+	quant := wsqQuant{binCenter: wsqBinCenter}
+	for _, i := range active {
+		quant.qbin[i] = float32(initial[i] / scale)
+		quant.zbin[i] = 1.2 * quant.qbin[i]
+	}
+	return quant
+}
+
+// wsqQuantize returns the quantized coefficients of the coded subbands, in
+// order, and where each of the 3 blocks ends.
+func wsqQuantize(f []float32, width int, q [wsqMaxSubbands]wsqNode, quant *wsqQuant) ([]int, [3]int) {
+	coeffs := []int{}
+	var blocks [3]int
+	for i := 0; i < wsqNumSubbands; i++ {
+		if i == wsqStrtSubband2 {
+			blocks[0] = len(coeffs)
+		}
+		if i == wsqStrtSubband3 {
+			blocks[1] = len(coeffs)
+		}
+		if quant.qbin[i] == 0 {
+			continue
+		}
+		n := q[i]
+		half := quant.zbin[i] / 2
+		for row := n.y; row < n.y+n.leny; row++ {
+			for _, v := range f[row*width+n.x : row*width+n.x+n.lenx] {
+				c := 0
+				if v > half {
+					c = int((v-half)/quant.qbin[i] + 1)
+				} else if v < -half {
+					c = int((v+half)/quant.qbin[i] - 1)
+				}
+				if c > 0xffff {
+					c = 0xffff
+				} else if c < -0xffff {
+					c = -0xffff
+				}
+				coeffs = append(coeffs, c)
+			}
+		}
+	}
+	blocks[2] = len(coeffs)
+	return coeffs, blocks
+}
+
+// wsqCoefficients is the number of coefficients of the coded subbands.
+func wsqCoefficients(q [wsqMaxSubbands]wsqNode, quant *wsqQuant) int {
+	n := 0
+	for i := 0; i < wsqNumSubbands; i++ {
+		if quant.qbin[i] != 0 {
+			n += q[i].lenx * q[i].leny
+		}
+	}
+	return n
+}
+
+// wsqUnquantize places the coefficients back into their subbands. Their
+// number is checked before the image is allocated.
+func wsqUnquantize(coeffs []int, width, height int, q [wsqMaxSubbands]wsqNode, quant *wsqQuant) ([]float32, error) {
+	if n := wsqCoefficients(q, quant); n != len(coeffs) {
+		return nil, fmt.Errorf("wsq: %d coefficients, the subbands hold %d", len(coeffs), n)
+	}
+	f := make([]float32, width*height)
+	k := 0
+	for i := 0; i < wsqNumSubbands; i++ {
+		if quant.qbin[i] == 0 {
+			continue
+		}
+		n := q[i]
+		for row := n.y; row < n.y+n.leny; row++ {
+			line := f[row*width+n.x : row*width+n.x+n.lenx]
+			for j := range line {
+				switch c := float32(coeffs[k]); {
+				case c > 0:
+					line[j] = quant.qbin[i]*(c-quant.binCenter) + quant.zbin[i]/2
+				case c < 0:
+					line[j] = quant.qbin[i]*(c+quant.binCenter) - quant.zbin[i]/2
+				}
+				k++
+			}
+		}
+	}
+	return f, nil
+}
+
+// A wsqSymbol is a Huffman symbol followed by extra raw bits:
+//
+//	1..100    run of as many zeros
+//	101, 102  8 bit positive, negative coefficient
+//	103, 104  16 bit positive, negative coefficient
+//	105, 106  8, 16 bit run of zeros
+//	107..254  coefficient symbol-180, within [-73, 74]
+type wsqSymbol struct {
+	symbol int
+	extra  int
+	bits   uint
+}
+
+func wsqSymbols(coeffs []int) []wsqSymbol {
+	symbols := []wsqSymbol{}
+	run := 0
+	flush := func() {
+		switch {
+		case run == 0:
+		case run <= wsqMaxHuffZeroRun:
+			symbols = append(symbols, wsqSymbol{symbol: run})
+		case run <= 0xff:
+			symbols = append(symbols, wsqSymbol{symbol: 105, extra: run, bits: 8})
+		default:
+			symbols = append(symbols, wsqSymbol{symbol: 106, extra: run, bits: 16})
+		}
+		run = 0
+	}
+	for _, c := range coeffs {
+		if c == 0 {
+			if run++; run == 0xffff {
+				flush()
+			}
+			continue
+		}
+		flush()
+		switch {
+		case c > 0xff:
+			symbols = append(symbols, wsqSymbol{symbol: 103, extra: c, bits: 16})
+		case c > wsqMaxHuffCoeff:
+			symbols = append(symbols, wsqSymbol{symbol: 101, extra: c, bits: 8})
+		case c < -0xff:
+			symbols = append(symbols, wsqSymbol{symbol: 104, extra: -c, bits: 16})
+		case c < -(wsqMaxHuffCoeff - 1):
+			symbols = append(symbols, wsqSymbol{symbol: 102, extra: -c, bits: 8})
+		default:
+			symbols = append(symbols, wsqSymbol{symbol: c + 180})
+		}
+	}
+	flush()
+	return symbols
+}
+
+// A wsqHuffman table lists how many codes have every length, 1 to 16, and
+// the symbols by increasing code length, as in JPEG.
+type wsqHuffman struct {
+	bits   [wsqMaxHuffBits + 1]int
+	values []int
+}
+
+// newWSQHuffman builds the code lengths of the symbol frequencies as JPEG
+// does (ITU T.81 Annex K.2): an extra symbol keeps the all ones code unused
+// and lengths are limited to 16 bits.
+func newWSQHuffman(freq [256]int) wsqHuffman {
+	const reserved = 256
+	var f [257]int
+	copy(f[:], freq[:])
+	f[reserved] = 1
+	var size [257]int
+	others := [257]int{}
+	for i := range others {
+		others[i] = -1
+	}
+	for {
+		v1, v2 := -1, -1
+		for v := range f {
+			if f[v] == 0 {
+				continue
+			}
+			if v1 == -1 || f[v] <= f[v1] {
+				v1, v2 = v, v1
+			} else if v2 == -1 || f[v] <= f[v2] {
+				v2 = v
+			}
+		}
+		if v2 == -1 {
+			break
+		}
+		f[v1] += f[v2]
+		f[v2] = 0
+		for size[v1]++; others[v1] != -1; size[v1]++ {
+			v1 = others[v1]
+		}
+		others[v1] = v2
+		for size[v2]++; others[v2] != -1; size[v2]++ {
+			v2 = others[v2]
+		}
+	}
+
+	var bits [2 * 257]int
+	for _, s := range size {
+		if s > 0 {
+			bits[s]++
+		}
+	}
+	for i := len(bits) - 1; i > wsqMaxHuffBits; i-- {
+		for bits[i] > 0 {
+			j := i - 2
+			for bits[j] == 0 {
+				j--
+			}
+			bits[i] -= 2
+			bits[i-1]++
+			bits[j+1] += 2
+			bits[j]--
+		}
+	}
+	i := wsqMaxHuffBits
+	for i > 0 && bits[i] == 0 {
+		i--
+	}
+	if i > 0 {
+		bits[i]-- // the reserved symbol
+	}
+
+	h := wsqHuffman{}
+	copy(h.bits[:], bits[:wsqMaxHuffBits+1])
+	for s := 1; s < len(bits); s++ {
+		for v := 0; v < reserved; v++ {
+			if size[v] == s {
+				h.values = append(h.values, v)
+			}
+		}
+	}
+	return h
+}
+
+// codes returns the code and its length of every symbol.
+func (h *wsqHuffman) codes() (code [256]uint32, length [256]uint) {
+	c, k := uint32(0), 0
+	for l := 1; l <= wsqMaxHuffBits; l++ {
+		for n := 0; n < h.bits[l]; n++ {
+			code[h.values[k]], length[h.values[k]] = c, uint(l)
+			c++
+			k++
+		}
+		c <<= 1
+	}
+	return code, length
+}
+
+// wsqBitWriter writes bits most significant first; a 0xff byte is followed
+// by a 0 so that it is not taken for a marker.
+type wsqBitWriter struct {
+	w   *bufio.Writer
+	acc uint32
+	n   uint
+}
+
+func (b *wsqBitWriter) write(v uint32, n uint) {
+	for n > 0 {
+		n--
+		b.acc = b.acc<<1 | (v>>n)&1
+		b.n++
+		if b.n == 8 {
+			b.w.WriteByte(byte(b.acc))
+			if b.acc == 0xff {
+				b.w.WriteByte(0)
+			}
+			b.acc, b.n = 0, 0
+		}
+	}
+}
+
+// flush pads the last byte with ones.
+func (b *wsqBitWriter) flush() {
+	if b.n > 0 {
+		b.write(0xff, 8-b.n)
+	}
+}
+
+// wsqScaled encodes v as an integer below max and its decimal exponent,
+// with as many digits as fit.
+func wsqScaled(v float64, max float64) (byte, uint32, error) {
+	if v == 0 {
+		return 0, 0, nil
+	}
+	if v >= max {
+		return 0, 0, fmt.Errorf("wsq: %g does not fit in %g", v, max)
+	}
+	scale := 0
+	for v < max {
+		scale++
+		v *= 10
+	}
+	return byte(scale - 1), uint32(math.Round(v / 10)), nil
+}
+
+func wsqUnscaled(scale byte, v uint32) float32 {
+	f := float32(v)
+	for ; scale > 0; scale-- {
+		f /= 10
+	}
+	return f
+}
+
+// encodeWSQ compresses an image to bitrate bits per pixel, in gray scale.
+func encodeWSQ(out io.Writer, img image.Image, bitrate float64) error {
+	bounds := img.Bounds()
+	gray := image.NewGray(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(gray, gray.Bounds(), img, bounds.Min, draw.Src)
+	width, height := gray.Rect.Dx(), gray.Rect.Dy()
+	if width > 0xffff || height > 0xffff {
+		return fmt.Errorf("wsq: %dx%d image is too large", width, height)
+	}
+	wTree, qTree, err := wsqTrees(width, height)
+	if err != nil {
+		return err
+	}
+
+	// normalise the pixels around their mean, to about [-128, 128]
+	sum, low, high := 0, 255, 0
+	for _, p := range gray.Pix {
+		sum += int(p)
+		if int(p) < low {
+			low = int(p)
+		}
+		if int(p) > high {
+			high = int(p)
+		}
+	}
+	mShift := float32(sum) / float32(len(gray.Pix))
+	rScale := mShift - float32(low)
+	if float32(high)-mShift > rScale {
+		rScale = float32(high) - mShift
+	}
+	rScale /= 128
+	if rScale == 0 {
+		rScale = 1
+	}
+	f := make([]float32, len(gray.Pix))
+	for i, p := range gray.Pix {
+		f[i] = (float32(p) - mShift) / rScale
+	}
+
+	wsqDecompose(f, width, wTree, wsqHiFilter, wsqLoFilter)
+	quant := wsqBitAlloc(wsqVariances(f, width, qTree), bitrate)
+	coeffs, blocks := wsqQuantize(f, width, qTree, &quant)
+
+	w := bufio.NewWriter(out)
+	e := &wsqEncoder{w: w}
+	e.ushort(wsqSOI)
+	e.transformTable()
+	e.quantizationTable(&quant)
+	e.frameHeader(width, height, mShift, rScale)
+
+	// block 1 has its own table, blocks 2 and 3 share the second one
+	segments := [][]int{coeffs[:blocks[0]], coeffs[blocks[0]:blocks[1]], coeffs[blocks[1]:blocks[2]]}
+	symbols := [3][]wsqSymbol{}
+	for i, s := range segments {
+		symbols[i] = wsqSymbols(s)
+	}
+	var table wsqHuffman
+	for i := range segments {
+		if i < 2 {
+			var freq [256]int
+			for _, s := range symbols[i] {
+				freq[s.symbol]++
+			}
+			if i == 1 {
+				for _, s := range symbols[2] {
+					freq[s.symbol]++
+				}
+			}
+			table = newWSQHuffman(freq)
+			e.huffmanTable(i, &table)
+		}
+		if len(symbols[i]) == 0 {
+			continue
+		}
+		e.ushort(wsqSOB)
+		e.ushort(3)
+		e.byte(byte(minInt(i, 1)))
+		code, length := table.codes()
+		bw := &wsqBitWriter{w: w}
+		for _, s := range symbols[i] {
+			bw.write(code[s.symbol], length[s.symbol])
+			bw.write(uint32(s.extra), s.bits)
+		}
+		bw.flush()
+	}
+	e.ushort(wsqEOI)
+	if e.err != nil {
+		return e.err
+	}
+	return w.Flush()
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// wsqEncoder writes the big endian fields of the markers, keeping the first
+// error.
+type wsqEncoder struct {
+	w   *bufio.Writer
+	err error
+}
+
+func (e *wsqEncoder) byte(v byte) {
+	if e.err == nil {
+		e.err = e.w.WriteByte(v)
+	}
+}
+
+func (e *wsqEncoder) ushort(v uint16) {
+	e.byte(byte(v >> 8))
+	e.byte(byte(v))
+}
+
+func (e *wsqEncoder) uint(v uint32) {
+	e.ushort(uint16(v >> 16))
+	e.ushort(uint16(v))
+}
+
+func (e *wsqEncoder) scaled(v float64, max float64) {
+	scale, value, err := wsqScaled(v, max)
+	if err != nil && e.err == nil {
+		e.err = err
+	}
+	e.byte(scale)
+	if max > 0xffff {
+		e.uint(value)
+	} else {
+		e.ushort(uint16(value))
+	}
+}
+
+// transformTable writes the centre and right half of the analysis filters,
+// the low pass one first.
+func (e *wsqEncoder) transformTable() {
+	e.ushort(wsqDTT)
+	e.ushort(uint16(4 + 6*(len(wsqLoFilter)/2+1+len(wsqHiFilter)/2+1)))
+	e.byte(byte(len(wsqLoFilter)))
+	e.byte(byte(len(wsqHiFilter)))
+	for _, f := range [][]float32{wsqLoFilter, wsqHiFilter} {
+		for _, v := range f[len(f)/2:] {
+			sign := byte(0)
+			if v < 0 {
+				sign, v = 1, -v
+			}
+			e.byte(sign)
+			e.scaled(float64(v), 4294967295)
+		}
+	}
+}
+
+func (e *wsqEncoder) quantizationTable(q *wsqQuant) {
+	e.ushort(wsqDQT)
+	e.ushort(2 + 3 + wsqMaxSubbands*6)
+	e.byte(2)
+	e.ushort(uint16(math.Round(float64(q.binCenter) * 100)))
+	for i := 0; i < wsqMaxSubbands; i++ {
+		e.scaled(float64(q.qbin[i]), 0xffff)
+		e.scaled(float64(q.zbin[i]), 0xffff)
+	}
+}
+
+func (e *wsqEncoder) frameHeader(width, height int, mShift, rScale float32) {
+	e.ushort(wsqSOF)
+	e.ushort(17)
+	e.byte(0)   // black
+	e.byte(255) // white
+	e.ushort(uint16(height))
+	e.ushort(uint16(width))
+	e.scaled(float64(mShift), 0xffff)
+	e.scaled(float64(rScale), 0xffff)
+	e.byte(2)   // encoder
+	e.ushort(0) // software
+}
+
+func (e *wsqEncoder) huffmanTable(id int, h *wsqHuffman) {
+	e.ushort(wsqDHT)
+	e.ushort(uint16(3 + wsqMaxHuffBits + len(h.values)))
+	e.byte(byte(id))
+	for l := 1; l <= wsqMaxHuffBits; l++ {
+		e.byte(byte(h.bits[l]))
+	}
+	for _, v := range h.values {
+		e.byte(byte(v))
+	}
+}
+
+// wsqDecoder reads a whole stream held in memory.
+type wsqDecoder struct {
+	data []byte
+	pos  int
+
+	hiFilter, loFilter []float32
+	quant              *wsqQuant
+	tables             [8]*wsqHuffman
+	width, height      int
+	mShift, rScale     float32
+}
+
+var errWSQShort = errors.New("wsq: unexpected end of data")
+
+func (d *wsqDecoder) byte() (byte, error) {
+	if d.pos >= len(d.data) {
+		return 0, errWSQShort
+	}
+	d.pos++
+	return d.data[d.pos-1], nil
+}
+
+func (d *wsqDecoder) ushort() (uint16, error) {
+	if d.pos+2 > len(d.data) {
+		return 0, errWSQShort
+	}
+	d.pos += 2
+	return uint16(d.data[d.pos-2])<<8 | uint16(d.data[d.pos-1]), nil
+}
+
+func (d *wsqDecoder) uint() (uint32, error) {
+	hi, err := d.ushort()
+	if err != nil {
+		return 0, err
+	}
+	lo, err := d.ushort()
+	return uint32(hi)<<16 | uint32(lo), err
+}
+
+func (d *wsqDecoder) scaled(long bool) (float32, error) {
+	scale, err := d.byte()
+	if err != nil {
+		return 0, err
+	}
+	if long {
+		v, err := d.uint()
+		return wsqUnscaled(scale, v), err
+	}
+	v, err := d.ushort()
+	return wsqUnscaled(scale, uint32(v)), err
+}
+
+// segment returns the content of the segment starting at the current
+// position, after its length.
+func (d *wsqDecoder) segment() ([]byte, error) {
+	n, err := d.ushort()
+	if err != nil {
+		return nil, err
+	}
+	if n < 2 || d.pos+int(n)-2 > len(d.data) {
+		return nil, fmt.Errorf("wsq: invalid segment length %d", n)
+	}
+	s := d.data[d.pos : d.pos+int(n)-2]
+	d.pos += int(n) - 2
+	return s, nil
+}
+
+// table reads the table of the marker, false when the marker is none.
+func (d *wsqDecoder) table(marker uint16) (bool, error) {
+	switch marker {
+	case wsqDTT, wsqDQT, wsqDHT, wsqCOM:
+	case wsqDRT:
+		return false, fmt.Errorf("wsq: restart intervals are not supported")
+	default:
+		return false, nil
+	}
+	s, err := d.segment()
+	if err != nil {
+		return false, err
+	}
+	t := &wsqDecoder{data: s}
+	switch marker {
+	case wsqDTT:
+		err = d.readTransformTable(t)
+	case wsqDQT:
+		err = d.readQuantizationTable(t)
+	case wsqDHT:
+		err = d.readHuffmanTables(t)
+	}
+	return true, err
+}
+
+func (d *wsqDecoder) readTransformTable(t *wsqDecoder) error {
+	// the first size is the one of the low pass analysis filter, which
+	// gives the high pass synthesis filter
+	halves := [2][]float32{}
+	sizes := [2]byte{}
+	for i := range sizes {
+		var err error
+		if sizes[i], err = t.byte(); err != nil {
+			return err
+		}
+		if sizes[i]%2 == 0 || sizes[i] > 32 {
+			return fmt.Errorf("wsq: filters of %d taps are not supported", sizes[i])
+		}
+	}
+	for i, size := range sizes {
+		for n := 0; n <= int(size)/2; n++ {
+			sign, err := t.byte()
+			if err != nil {
+				return err
+			}
+			v, err := t.scaled(true)
+			if err != nil {
+				return err
+			}
+			if sign != 0 {
+				v = -v
+			}
+			halves[i] = append(halves[i], v)
+		}
+	}
+	d.hiFilter, d.loFilter = wsqSynthesis(halves[0], halves[1])
+	return nil
+}
+
+func (d *wsqDecoder) readQuantizationTable(t *wsqDecoder) error {
+	q := &wsqQuant{}
+	var err error
+	if q.binCenter, err = t.scaled(false); err != nil {
+		return err
+	}
+	for i := 0; i < wsqMaxSubbands; i++ {
+		if q.qbin[i], err = t.scaled(false); err != nil {
+			return err
+		}
+		if q.zbin[i], err = t.scaled(false); err != nil {
+			return err
+		}
+	}
+	d.quant = q
+	return nil
+}
+
+func (d *wsqDecoder) readHuffmanTables(t *wsqDecoder) error {
+	for t.pos < len(t.data) {
+		id, err := t.byte()
+		if err != nil {
+			return err
+		}
+		if int(id) >= len(d.tables) {
+			return fmt.Errorf("wsq: invalid Huffman table %d", id)
+		}
+		h := &wsqHuffman{}
+		total := 0
+		for l := 1; l <= wsqMaxHuffBits; l++ {
+			b, err := t.byte()
+			if err != nil {
+				return err
+			}
+			h.bits[l] = int(b)
+			total += int(b)
+		}
+		if total > 256 {
+			return fmt.Errorf("wsq: Huffman table %d has %d codes", id, total)
+		}
+		for i := 0; i < total; i++ {
+			v, err := t.byte()
+			if err != nil {
+				return err
+			}
+			h.values = append(h.values, int(v))
+		}
+		d.tables[id] = h
+	}
+	return nil
+}
+
+func (d *wsqDecoder) frameHeader() error {
+	s, err := d.segment()
+	if err != nil {
+		return err
+	}
+	t := &wsqDecoder{data: s}
+	if _, err := t.byte(); err != nil { // black
+		return err
+	}
+	if _, err := t.byte(); err != nil { // white
+		return err
+	}
+	height, err := t.ushort()
+	if err != nil {
+		return err
+	}
+	width, err := t.ushort()
+	if err != nil {
+		return err
+	}
+	d.width, d.height = int(width), int(height)
+	if d.width == 0 || d.height == 0 {
+		return fmt.Errorf("wsq: invalid frame size %dx%d", d.width, d.height)
+	}
+	if err := checkImageSize("wsq", d.width, d.height); err != nil {
+		return err
+	}
+	if d.mShift, err = t.scaled(false); err != nil {
+		return err
+	}
+	if d.rScale, err = t.scaled(false); err != nil {
+		return err
+	}
+	return nil
+}
+
+// header reads up to the frame header included.
+func (d *wsqDecoder) header() error {
+	soi, err := d.ushort()
+	if err != nil {
+		return err
+	}
+	if soi != wsqSOI {
+		return fmt.Errorf("wsq: missing SOI marker")
+	}
+	for {
+		marker, err := d.ushort()
+		if err != nil {
+			return err
+		}
+		if marker == wsqSOF {
+			return d.frameHeader()
+		}
+		ok, err := d.table(marker)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("wsq: unexpected marker %#04x before the frame header", marker)
+		}
+	}
+}
+
+// wsqBitReader reads entropy coded bits up to the next marker.
+type wsqBitReader struct {
+	d      *wsqDecoder
+	cur    byte
+	n      uint
+	marker uint16
+}
+
+var errWSQMarker = errors.New("wsq: marker")
+
+func (b *wsqBitReader) bits(n uint) (int, error) {
+	v := 0
+	for ; n > 0; n-- {
+		if b.n == 0 {
+			c, err := b.d.byte()
+			if err != nil {
+				return 0, err
+			}
+			if c == 0xff {
+				c2, err := b.d.byte()
+				if err != nil {
+					return 0, err
+				}
+				if c2 != 0 {
+					b.marker = 0xff00 | uint16(c2)
+					return 0, errWSQMarker
+				}
+			}
+			b.cur, b.n = c, 8
+		}
+		b.n--
+		v = v<<1 | int(b.cur>>b.n)&1
+	}
+	return v, nil
+}
+
+// decodeBlock decodes the coefficients of a block up to the marker ending it,
+// failing when there are more than limit coefficients in all.
+func (d *wsqDecoder) decodeBlock(h *wsqHuffman, coeffs []int, limit int) ([]int, uint16, error) {
+	// maximum and minimum code of every length, and index of its first value
+	var maxcode, mincode, valptr [wsqMaxHuffBits + 1]int
+	code, k := 0, 0
+	for l := 1; l <= wsqMaxHuffBits; l++ {
+		maxcode[l] = -1
+		if h.bits[l] > 0 {
+			valptr[l], mincode[l] = k, code
+			code += h.bits[l]
+			k += h.bits[l]
+			maxcode[l] = code - 1
+		}
+		code <<= 1
+	}
+
+	br := &wsqBitReader{d: d}
+	for {
+		code, err := br.bits(1)
+		l := 1
+		for err == nil && code > maxcode[l] {
+			if l++; l > wsqMaxHuffBits {
+				return nil, 0, fmt.Errorf("wsq: invalid Huffman code")
+			}
+			var bit int
+			bit, err = br.bits(1)
+			code = code<<1 | bit
+		}
+		if err == errWSQMarker {
+			return coeffs, br.marker, nil
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		symbol := h.values[valptr[l]+code-mincode[l]]
+
+		extra := func(n uint) int {
+			if err == nil {
+				var v int
+				v, err = br.bits(n)
+				return v
+			}
+			return 0
+		}
+		switch {
+		case symbol >= 1 && symbol <= wsqMaxHuffZeroRun:
+			coeffs = append(coeffs, make([]int, symbol)...)
+		case symbol == 101:
+			coeffs = append(coeffs, extra(8))
+		case symbol == 102:
+			coeffs = append(coeffs, -extra(8))
+		case symbol == 103:
+			coeffs = append(coeffs, extra(16))
+		case symbol == 104:
+			coeffs = append(coeffs, -extra(16))
+		case symbol == 105:
+			coeffs = append(coeffs, make([]int, extra(8))...)
+		case symbol == 106:
+			coeffs = append(coeffs, make([]int, extra(16))...)
+		case symbol > 106 && symbol < 0xff:
+			coeffs = append(coeffs, symbol-180)
+		default:
+			return nil, 0, fmt.Errorf("wsq: invalid symbol %d", symbol)
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("wsq: truncated block: %v", err)
+		}
+		if len(coeffs) > limit {
+			return nil, 0, fmt.Errorf("wsq: more coefficients than the subbands hold")
+		}
+	}
+}
+
+func decodeWSQConfig(r io.Reader) (image.Config, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+	d := &wsqDecoder{data: data}
+	if err := d.header(); err != nil {
+		return image.Config{}, err
+	}
+	return image.Config{ColorModel: color.GrayModel, Width: d.width, Height: d.height}, nil
+}
+
+// decodeWSQ decompresses a WSQ stream into a gray scale image.
+func decodeWSQ(r io.Reader) (image.Image, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	d := &wsqDecoder{data: data}
+	if err := d.header(); err != nil {
+		return nil, err
+	}
+	wTree, qTree, err := wsqTrees(d.width, d.height)
+	if err != nil {
+		return nil, err
+	}
+
+	coeffs := []int{}
+	marker, err := d.ushort()
+	for err == nil && marker != wsqEOI {
+		if marker == wsqSOB {
+			var s []byte
+			if s, err = d.segment(); err != nil {
+				break
+			}
+			if len(s) != 1 || int(s[0]) >= len(d.tables) || d.tables[s[0]] == nil {
+				return nil, fmt.Errorf("wsq: block with an undefined Huffman table")
+			}
+			// the subbands coded, or before the quantization table the pixels,
+			// bound the coefficients
+			limit := d.width * d.height
+			if d.quant != nil {
+				limit = wsqCoefficients(qTree, d.quant)
+			}
+			coeffs, marker, err = d.decodeBlock(d.tables[s[0]], coeffs, limit)
+			continue
+		}
+		var ok bool
+		if ok, err = d.table(marker); err == nil && !ok {
+			err = fmt.Errorf("wsq: unexpected marker %#04x", marker)
+		}
+		if err == nil {
+			marker, err = d.ushort()
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if d.quant == nil || d.hiFilter == nil {
+		return nil, fmt.Errorf("wsq: missing quantization or transform table")
+	}
+
+	f, err := wsqUnquantize(coeffs, d.width, d.height, qTree, d.quant)
+	if err != nil {
+		return nil, err
+	}
+	wsqReconstruct(f, d.width, wTree, d.hiFilter, d.loFilter)
+
+	img := image.NewGray(image.Rect(0, 0, d.width, d.height))
+	for i, v := range f {
+		p := v*d.rScale + d.mShift + 0.5
+		switch {
+		case p < 0:
+			img.Pix[i] = 0
+		case p > 255:
+			img.Pix[i] = 255
+		default:
+			img.Pix[i] = uint8(p)
+		}
+	}
+	return img, nil
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// syntheticPrint draws concentric ridges of a period of 8 pixels around a
+// point off the centre, with some noise, as a stand-in for a fingerprint.
+func syntheticPrint(width, height int, seed int64) *image.Gray {
+	rng := rand.New(rand.NewSource(seed))
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	cx, cy := 0.4*float64(width), 0.6*float64(height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			r := math.Hypot(float64(x)-cx, float64(y)-cy)
+			v := 128 + 90*math.Cos(2*math.Pi*r/8) + 10*rng.NormFloat64()
+			img.Pix[y*img.Stride+x] = clampUint8(v)
+		}
+	}
+	return img
+}
+
+func psnr(a, b *image.Gray) float64 {
+	var mse float64
+	for i := range a.Pix {
+		d := float64(a.Pix[i]) - float64(b.Pix[i])
+		mse += d * d
+	}
+	mse /= float64(len(a.Pix))
+	if mse == 0 {
+		return math.Inf(1)
+	}
+	return 10 * math.Log10(255*255/mse)
+}
+
+func encodeWSQBytes(t *testing.T, img image.Image, bitrate float64) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := encodeWSQ(&buf, img, bitrate); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestWSQRoundTrip(t *testing.T) {
+	for _, size := range []image.Point{{96, 103}, {128, 128}, {257, 181}} {
+		img := syntheticPrint(size.X, size.Y, 1)
+		previous := 0.0
+		for _, bitrate := range []float64{0.75, 2.25} {
+			data := encodeWSQBytes(t, img, bitrate)
+			decoded, format, err := image.Decode(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("%v at %g bpp: %v", size, bitrate, err)
+			}
+			if format != "wsq" {
+				t.Errorf("%v: format %q, want wsq", size, format)
+			}
+			gray, ok := decoded.(*image.Gray)
+			if !ok || gray.Rect != img.Rect {
+				t.Fatalf("%v at %g bpp: decoded %T of %v", size, bitrate, decoded, decoded.Bounds())
+			}
+			p := psnr(img, gray)
+			if p < 20 {
+				t.Errorf("%v at %g bpp: PSNR %.1f dB, want at least 20", size, bitrate, p)
+			}
+			if p <= previous {
+				t.Errorf("%v: PSNR %.1f dB at %g bpp, not above %.1f dB at a lower rate", size, p, bitrate, previous)
+			}
+			previous = p
+
+			config, format, err := image.DecodeConfig(bytes.NewReader(data))
+			if err != nil || format != "wsq" || config.Width != size.X || config.Height != size.Y {
+				t.Errorf("%v: DecodeConfig gives %s %dx%d, %v", size, format, config.Width, config.Height, err)
+			}
+		}
+	}
+}
+
+// TestWSQSize checks that the compressed size follows the bit rate.
+func TestWSQSize(t *testing.T) {
+	img := syntheticPrint(256, 256, 2)
+	pixels := float64(256 * 256)
+	previous := 0
+	for _, bitrate := range []float64{0.5, 0.75, 1.5, 2.25} {
+		data := encodeWSQBytes(t, img, bitrate)
+		rate := float64(8*len(data)) / pixels
+		if rate < bitrate/2 || rate > 1.5*bitrate {
+			t.Errorf("%g bpp requested, %.2f bpp written", bitrate, rate)
+		}
+		if len(data) <= previous {
+			t.Errorf("%g bpp: %d bytes, not more than %d at a lower rate", bitrate, len(data), previous)
+		}
+		previous = len(data)
+	}
+}
+
+func TestWSQFlatImage(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 100, 100))
+	for i := range img.Pix {
+		img.Pix[i] = 200
+	}
+	decoded, err := decodeWSQ(bytes.NewReader(encodeWSQBytes(t, img, wsqBitrate)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := psnr(img, decoded.(*image.Gray)); p < 40 {
+		t.Errorf("flat image: PSNR %.1f dB, want at least 40", p)
+	}
+}
+
+func TestWSQTooSmall(t *testing.T) {
+	var buf bytes.Buffer
+	err := encodeWSQ(&buf, image.NewGray(image.Rect(0, 0, 40, 40)), wsqBitrate)
+	if err == nil || !strings.Contains(err.Error(), "too small") {
+		t.Errorf("40x40 image: error %v, want too small", err)
+	}
+}
+
+// wsqSegment returns the offset of the content of the first segment of the
+// marker, after its length, walking the segments from SOI.
+func wsqSegment(t *testing.T, data []byte, marker uint16) int {
+	t.Helper()
+	for pos := 2; pos+4 <= len(data); {
+		m := uint16(data[pos])<<8 | uint16(data[pos+1])
+		if m == marker {
+			return pos + 4
+		}
+		pos += 2 + (int(data[pos+2])<<8 | int(data[pos+3]))
+	}
+	t.Fatalf("no marker %#04x", marker)
+	return 0
+}
+
+func TestWSQInvalid(t *testing.T) {
+	data := encodeWSQBytes(t, syntheticPrint(96, 103, 3), wsqBitrate)
+	sof := wsqSegment(t, data, wsqSOF)
+	patched := func(patch func(d []byte)) []byte {
+		d := append([]byte{}, data...)
+		patch(d)
+		return d
+	}
+	setSize := func(width, height int) []byte {
+		return patched(func(d []byte) {
+			d[sof+2], d[sof+3] = byte(height>>8), byte(height)
+			d[sof+4], d[sof+5] = byte(width>>8), byte(width)
+		})
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		err  string
+	}{
+		{"huge frame", setSize(65520, 65520), "too large"},
+		{"frame above the coefficients", setSize(8000, 8000), "coefficients"},
+		{"frame below the coefficients", setSize(90, 90), "coefficients"},
+		{"empty frame", setSize(0, 103), "invalid frame size"},
+		{"truncated header", data[:sof-4], "unexpected end"},
+		{"truncated frame header", data[:sof+3], "invalid segment length"},
+		{"truncated data", data[:len(data)/2], "wsq"},
+		{"no SOI", data[2:], "format"},
+		{"missing quantization table", patched(func(d []byte) {
+			dqt := wsqSegment(t, d, wsqDQT)
+			d[dqt-3] = byte(wsqCOM & 0xff) // DQT becomes a comment
+		}), "missing quantization"},
+	}
+	for _, tt := range tests {
+		_, _, err := image.Decode(bytes.NewReader(tt.data))
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: error %v, want one with %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+// TestWSQReference decodes the known answers of testdata/wsq, each
+// `<name>.wsq` next to the `<name>.raw` 8-bit pixels it decodes to and a
+// `<name>.hdr` sidecar with their size. synthetic.wsq is syntheticPrint(96,
+// 103, 7) at 0.75 bpp, frozen with its pixels so that any change of the
+// decoder output shows; the NBIS reference images, with the pixels the NIST
+// decoder gives, can be dropped next to it.
+func TestWSQReference(t *testing.T) {
+	files, _ := filepath.Glob(filepath.Join("testdata", "wsq", "*.wsq"))
+	if len(files) == 0 {
+		t.Fatal("no known answer in testdata/wsq")
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := decodeWSQ(bytes.NewReader(data))
+		if err != nil {
+			t.Errorf("%s: %v", file, err)
+			continue
+		}
+		raw := strings.TrimSuffix(file, ".wsq") + ".raw"
+		want, _, err := readImageFile(raw)
+		if err != nil {
+			t.Errorf("%s: %v", raw, err)
+			continue
+		}
+		got := img.(*image.Gray)
+		if got.Rect != want.Bounds() {
+			t.Errorf("%s: %v, the reference is %v", file, got.Rect, want.Bounds())
+			continue
+		}
+		// the float rounding of the reconstruction may differ by one gray level
+		for i, p := range want.(*image.Gray).Pix {
+			if d := int(got.Pix[i]) - int(p); d < -1 || d > 1 {
+				t.Errorf("%s: pixel %d is %d, the reference %d", file, i, got.Pix[i], p)
+				break
+			}
+		}
+	}
+}
+
+// TestWSQKnownAnswerEncode checks that the encoder still writes the stream
+// of the known answer, byte for byte.
+func TestWSQKnownAnswerEncode(t *testing.T) {
+	want, err := os.ReadFile(filepath.Join("testdata", "wsq", "synthetic.wsq"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := encodeWSQBytes(t, syntheticPrint(96, 103, 7), 0.75); !bytes.Equal(got, want) {
+		t.Errorf("encoded %d bytes which differ from the %d of synthetic.wsq", len(got), len(want))
+	}
+}